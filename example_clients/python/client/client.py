@@ -2,7 +2,7 @@
 
 import asyncio
 from json import dumps, loads
-from typing import Awaitable, Callable, Dict, List
+from typing import Awaitable, Callable, Dict
 
 import websockets
 from websockets.exceptions import ConnectionClosed, ConnectionClosedError
@@ -14,8 +14,11 @@ class Client:
     def __init__(self, base_url: str):
         self.loop = asyncio.get_event_loop()
         self.handlers: Dict[str, Callable[[str, str], Awaitable[None]]] = {
-            "S_UserList": self.handle_userlist,
-            "S_NewUser": self.handle_newuser,
+            "S_UserList": self.handle_dummy,
+            "S_Session": self.handle_dummy,
+            "S_NewUser": self.handle_dummy,
+            "S_UserLeft": self.handle_dummy,
+            "S_AttachPending": self.handle_pending,
             "S_Attached": self.handle_attached,
             "S_Detached": self.handle_detach,
             "S_HookEvt": self.handle_hookevt,
@@ -27,24 +30,13 @@ class Client:
         # Load data required for parsing tags
         self.recruit = Recruit(base_url)
 
-    async def handle_userlist(self, op: str, payload: str):
-        users: List[str] = loads(payload)
-        if len(users) > 0:
-            # Attempt to attach to the most recently connected user.
-            await self.send_attach(users[-1])
-        # Remove the handler
-        return self.handlers["S_UserList"]
-
     # Dummy handler for server packets we're not really interested in.
     async def handle_dummy(self, op: str, payload: str):
         pass
 
-    async def handle_newuser(self, op: str, payload: str):
-        user: str = loads(payload)
-        # Attempt to attach to a new user
-        if self.attached_user != "":
-            await self.send_detach()
-        await self.send_attach(user)
+    async def handle_pending(self, op: str, payload: str):
+        # No user is connected yet, the server attaches us once one connects.
+        print("waiting for a user to connect")
 
     async def handle_get(self, op: str, payload: str):
         self.recruit.parse_tags(payload)
@@ -61,6 +53,8 @@ class Client:
         await self.send_hook("packet", "S/gacha/refreshTags", True)
 
     async def handle_detach(self, op: str, payload: str):
+        # The server detaches us from the previous user when a new user connects,
+        # hooks registered on the previous user are removed.
         self.attached_user = ""
 
     async def handle_hookevt(self, op: str, payload: str):
@@ -88,6 +82,9 @@ class Client:
     async def run(self):
         async with websockets.connect(f"ws://{self.base_url}/ws") as ws:
             self.ws = ws
+            # Let the server attach us to the most recently connected user, and
+            # move us to every user that connects afterwards.
+            await self.send_attach("@latest")
             try:
                 while True:
                     s: str = await ws.recv()
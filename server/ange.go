@@ -12,12 +12,23 @@ import (
 	"github.com/rs/cors"
 )
 
+// Version is the build version of angelina reported to clients in S_Hello, it
+// may be overridden at build time with -ldflags "-X".
+var Version = "0.1-alpha"
+
+// Region of the gamedata tables loaded on Run.
+const gameDataRegion = "GL"
+
 type Ange struct {
 	log.Logger
-	gamedata  *gamedata.GameData
-	staticDir string
-	host      string
-	upgrader  websocket.Upgrader
+	gamedata *gamedata.GameData
+	// Game data tables served to clients by name, only accessed once
+	// gameDataReady is closed.
+	gameTables    map[string]gameTable
+	gameDataReady chan struct{}
+	staticDir     string
+	host          string
+	upgrader      websocket.Upgrader
 
 	// Maps a user ID to a slice of attached clients
 	attachedClients map[string][]*Client
@@ -25,17 +36,28 @@ type Ange struct {
 	modules map[string]*angeModule
 	// Registered clients.
 	clients map[*Client]bool
+	// Maps a session token to the client that owns it, including clients that
+	// have disconnected but may still resume their session.
+	sessions map[string]*Client
 
 	// Inbound messages from modules when they are initialized.
 	modAttach chan *angeModule
 	// Inbound messages from modules indicating a shutdown.
 	modDetach chan *angeModule
+	// Inbound messages from modules once their game state is loaded.
+	modReady chan *angeModule
 	// Inbound messages from the clients.
 	messages chan *messageT
 	// Register requests from the clients.
 	register chan *Client
 	// Unregister requests from clients.
 	unregister chan *Client
+	// Expiry of suspended sessions.
+	sessionExpired chan sessionExpiry
+	// Hooks that reached their event limit or TTL.
+	hookExpired chan hookExpiry
+	// C_WaitFor requests that matched an event or timed out.
+	waitDone chan waitResult
 }
 
 const (
@@ -58,25 +80,33 @@ func New(staticDir, host string, unsafeOrigin bool) *Ange {
 			WriteBufferSize: wsWriteBufSiz,
 			CheckOrigin:     checkFunc,
 		},
+		gameTables:      make(map[string]gameTable),
+		gameDataReady:   make(chan struct{}),
 		attachedClients: make(map[string][]*Client),
 		modules:         make(map[string]*angeModule),
 		clients:         make(map[*Client]bool),
+		sessions:        make(map[string]*Client),
 		modAttach:       make(chan *angeModule),
 		modDetach:       make(chan *angeModule),
+		modReady:        make(chan *angeModule),
 		messages:        make(chan *messageT),
 		register:        make(chan *Client),
 		unregister:      make(chan *Client),
+		sessionExpired:  make(chan sessionExpiry),
+		hookExpired:     make(chan hookExpiry),
+		waitDone:        make(chan waitResult),
 	}
 	return ange
 }
 
 func (ange *Ange) Run(logger log.Logger) {
-	gd, err := gamedata.New("GL", logger)
+	gd, err := gamedata.New(gameDataRegion, logger)
 	if err != nil {
 		panic(err)
 	}
 	ange.gamedata = gd
 	ange.Logger = logger
+	go ange.loadGameData()
 	go ange.runHub()
 	mux := http.NewServeMux()
 	if ange.staticDir != "" {
@@ -2,17 +2,19 @@ package server
 
 import (
 	"bytes"
-	"encoding/json"
-	"fmt"
 	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/elazarl/goproxy"
 	"github.com/gorilla/websocket"
 	"github.com/kyoukaya/rhine/proxy"
-	"github.com/kyoukaya/rhine/proxy/gamestate"
+	"github.com/kyoukaya/rhine/proxy/gamestate/statestruct"
 
 	"github.com/kyoukaya/angelina/server/msg"
+	"github.com/kyoukaya/angelina/server/query"
 )
 
 const (
@@ -33,20 +35,289 @@ var (
 
 // Client is a middleman between the websocket connection and the hub.
 type Client struct {
-	ange        *Ange
-	mod         *proxy.RhineModule
+	ange     *Ange
+	name     string          // Name declared by the client in C_Hello
+	features map[string]bool // Optional features enabled with C_Hello
+	// Users the client is attached to in the order they were attached, the
+	// first attachment is used by requests that don't specify a user.
+	attachments []*attachment
+	// Attach requests waiting for a user to connect, '@latest' requests are
+	// kept to follow the latest connected user.
+	pending     []*msg.Attach
 	hookCounter uint64 // Incrementing counter to produce unique hook IDs
-	hooks       map[uint64]*clientHook
-	listener    chan gamestate.StateEvent
+	hooks       map[string]*clientHook
+	// Pending C_WaitFor requests.
+	waits map[*waiter]bool
+	// ID of the request currently being handled, only accessed from the hub.
+	reqID string
+
+	// Session the client's hook events are sent through.
+	sess *session
 
 	// The websocket connection.
 	conn *websocket.Conn
 
 	// Buffered channel of outbound messages.
 	send chan []byte
+	// Unbuffered channel of streamed S_GetChunk messages, kept apart from send
+	// so that streams don't fill its buffer and other messages are interleaved
+	// with the chunks.
+	chunks chan []byte
+	// Closed by the hub when the client disconnects to stop the writePump. The
+	// send chan is never closed as hooks may still send to it.
+	quit chan struct{}
+}
+
+// attachment is a client's attachment to a game user.
+type attachment struct {
+	user   string             // User identifier '{REGION}_{UID}'
+	mod    *proxy.RhineModule // nil while a sticky attachment waits for the user
+	sticky bool               // Keep the attachment when the user disconnects
+	latest bool               // Made by the '@latest' attach policy
+}
+
+// attachment returns the client's attachment to a user, or nil if the client
+// isn't attached to the user.
+func (c *Client) attachment(user string) *attachment {
+	for _, a := range c.attachments {
+		if a.user == user {
+			return a
+		}
+	}
+	return nil
+}
+
+// pendingAttach returns the index of the client's pending attach request for a
+// user or policy, or -1 if there is none.
+func (c *Client) pendingAttach(user string) int {
+	for i, p := range c.pending {
+		if p.User == user {
+			return i
+		}
+	}
+	return -1
+}
+
+// users returns the users the client is attached to.
+func (c *Client) users() []string {
+	users := make([]string, 0, len(c.attachments))
+	for _, a := range c.attachments {
+		users = append(users, a.user)
+	}
+	return users
+}
+
+// module returns the client's attachment to a user for handling a request, or
+// the client's first attachment if no user is specified. An error is returned
+// if the client isn't attached or the user is disconnected.
+func (c *Client) module(user string) (*attachment, error) {
+	var a *attachment
+	if user == "" {
+		if len(c.attachments) == 0 {
+			return nil, newError(msg.CodeNotAttached, "Client is not attached")
+		}
+		a = c.attachments[0]
+	} else if a = c.attachment(user); a == nil {
+		return nil, newError(msg.CodeNotAttached, "Client is not attached to user '%s'", user)
+	}
+	if a.mod == nil {
+		return nil, newError(msg.CodeNotAttached, "User '%s' is disconnected", a.user)
+	}
+	return a, nil
+}
+
+// get returns the value at the path of a C_Get request from the user's game
+// state, with the request's projection applied.
+func (c *Client) get(get *msg.Get) (val interface{}, next string, err error) {
+	a, err := c.module(get.User)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := c.stateReady(a); err != nil {
+		return nil, "", err
+	}
+	projection, err := query.NewProjection(get.Fields)
+	if err != nil {
+		return nil, "", wrapError(msg.CodeBadPayload, err)
+	}
+	if get.PageSize < 0 {
+		return nil, "", newError(msg.CodeBadPayload, "Invalid page_size %d", get.PageSize)
+	}
+	if get.Path == "" {
+		// The whole game state can't be read safely, see rootKeys.
+		return nil, "", newError(msg.CodeBadPayload, "A path is required, use C_Keys to list the top-level keys")
+	}
+	val, err = a.mod.StateGet(get.Path)
+	if err != nil {
+		return nil, "", wrapError(msg.CodeStatePathNotFound, err)
+	}
+	if get.IsQuery() || len(projection) > 0 || get.PageSize > 0 || get.Stream {
+		// Streamed values are sent from another goroutine and must not share
+		// the game state.
+		if val, err = query.Normalize(val); err != nil {
+			return nil, "", err
+		}
+	}
+	if get.IsQuery() {
+		val, err = runQuery(get.Where, get.Sort, get.Limit, projection, val)
+		if err != nil {
+			return nil, "", err
+		}
+	} else if len(projection) > 0 {
+		val = projection.Apply(val)
+	}
+	if get.PageSize > 0 {
+		val, next, err = query.Page(val, get.Cursor, get.PageSize)
+		if err != nil {
+			return nil, "", wrapError(msg.CodeBadPayload, err)
+		}
+	} else if get.Cursor != "" {
+		return nil, "", newError(msg.CodeBadPayload, "Cursor requires a page_size")
+	}
+	return val, next, nil
+}
+
+// keys describes the value at a path of the game state and its children.
+func (c *Client) keys(req *msg.Keys) (*msg.KeyList, error) {
+	a, err := c.module(req.User)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.stateReady(a); err != nil {
+		return nil, err
+	}
+	if req.Path == "" {
+		return rootKeys(req.Prefix), nil
+	}
+	val, err := a.mod.StateGet(req.Path)
+	if err != nil {
+		return nil, wrapError(msg.CodeStatePathNotFound, err)
+	}
+	val, err = query.Normalize(val)
+	if err != nil {
+		return nil, err
+	}
+	ret := &msg.KeyList{Path: req.Path, KeyInfo: *keyInfo(nil, val), Keys: []*msg.KeyInfo{}}
+	switch t := val.(type) {
+	case map[string]interface{}:
+		for _, k := range query.SortedKeys(t) {
+			if strings.HasPrefix(k, req.Prefix) {
+				ret.Keys = append(ret.Keys, keyInfo(k, t[k]))
+			}
+		}
+	case []interface{}:
+		for i, v := range t {
+			if strings.HasPrefix(strconv.Itoa(i), req.Prefix) {
+				ret.Keys = append(ret.Keys, keyInfo(i, v))
+			}
+		}
+	}
+	return ret, nil
+}
+
+// rootKeys describes the top-level keys of the game state from the fields of its
+// type, without their sizes. Rhine only locks the game state while reading the
+// root, which is then encoded while deltas may be merged into it.
+func rootKeys(prefix string) *msg.KeyList {
+	t := reflect.TypeOf(statestruct.User{})
+	size := 0
+	keys := []*msg.KeyInfo{}
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		size++
+		if strings.HasPrefix(name, prefix) {
+			keys = append(keys, &msg.KeyInfo{Key: name, Type: typeName(t.Field(i).Type)})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Key.(string) < keys[j].Key.(string) })
+	return &msg.KeyList{KeyInfo: msg.KeyInfo{Type: "object", Size: &size}, Keys: keys}
+}
+
+// typeName returns the type of the values of a field of the game state, as
+// reported by C_Keys.
+func typeName(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		return "object"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	}
+	return "null"
+}
+
+func keyInfo(key, val interface{}) *msg.KeyInfo {
+	info := &msg.KeyInfo{Key: key, Type: query.TypeOf(val)}
+	if size := query.Length(val); size >= 0 {
+		info.Size = &size
+	}
+	return info
+}
+
+// runQuery runs a query, as sent in the query form of a C_Get payload, on a
+// normalized value.
+func runQuery(where string, sort []string, limit int, projection query.Projection, val interface{}) ([]query.Entry, error) {
+	if limit < 0 {
+		return nil, newError(msg.CodeBadPayload, "Invalid limit %d", limit)
+	}
+	q := &query.Query{Limit: limit, Fields: projection}
+	var err error
+	if where != "" {
+		if q.Where, err = query.Parse(where); err != nil {
+			return nil, wrapError(msg.CodeBadPayload, err)
+		}
+	}
+	if q.Sort, err = query.ParseSort(sort); err != nil {
+		return nil, wrapError(msg.CodeBadPayload, err)
+	}
+	entries, err := q.Run(val)
+	if err != nil {
+		return nil, wrapError(msg.CodeBadPayload, err)
+	}
+	return entries, nil
+}
+
+// removeAttachment removes the client's attachment to a user and unhooks the
+// hooks registered on the user.
+func (c *Client) removeAttachment(user string) {
+	c.cancelWaits(user)
+	for i, a := range c.attachments {
+		if a.user == user {
+			c.attachments = append(c.attachments[:i], c.attachments[i+1:]...)
+			break
+		}
+	}
+	for id, hook := range c.hooks {
+		if hook.user == user {
+			hook.Unhook()
+			delete(c.hooks, id)
+		}
+	}
 }
 
 func (c *Client) sendWrapper(data []byte) {
+	if c.sess.hold(data) {
+		return
+	}
+	c.push(data)
+}
+
+// push sends a message to the client's connection, it is discarded if the
+// client's send chan is full.
+func (c *Client) push(data []byte) {
 	select {
 	case c.send <- data:
 	default:
@@ -54,16 +325,31 @@ func (c *Client) sendWrapper(data []byte) {
 	}
 }
 
-func (c *Client) removeHook(id uint64) error {
+// reply sends a message tagged with the ID of the request currently being handled.
+func (c *Client) reply(data []byte) {
+	c.sendWrapper(msg.TagRequest(data, c.reqID))
+}
+
+func (c *Client) removeHook(id string) error {
 	hook := c.hooks[id]
 	if hook == nil {
-		return fmt.Errorf("Unable to find hook ID %d to unhook", id)
+		return newError(msg.CodeUnknownHook, "Unable to find hook ID '%s' to unhook", id)
 	}
 	hook.Unhook()
 	delete(c.hooks, id)
 	return nil
 }
 
+// sortedHooks returns the client's hooks in the order they were registered.
+func (c *Client) sortedHooks() []*clientHook {
+	hooks := make([]*clientHook, 0, len(c.hooks))
+	for _, hook := range c.hooks {
+		hooks = append(hooks, hook)
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].n < hooks[j].n })
+	return hooks
+}
+
 func (c *Client) unhookAll() {
 	for k, hook := range c.hooks {
 		hook.Unhook()
@@ -71,55 +357,174 @@ func (c *Client) unhookAll() {
 	}
 }
 
-func (c *Client) addHook(data *msg.Hook) error {
-	var hook proxy.Hooker
-	switch data.Kind {
-	case packetHook:
-		hook = c.mod.Hook(data.Target, 0, c.hookHandler)
-	case gameStateHook:
-		hook = c.mod.StateHook(data.Target, c.listener, data.Event)
-	default:
-		return fmt.Errorf("Unknown hook type '%s'", data.Kind)
+// unregisterHooks removes the client's hooks on a user from the RhineModule
+// while keeping them to be registered again with registerHooks. Pending
+// C_WaitFor requests on the user are ended.
+func (c *Client) unregisterHooks(user string) {
+	c.cancelWaits(user)
+	for _, hook := range c.hooks {
+		if hook.user == user {
+			hook.unregister()
+		}
+	}
+}
+
+// dropStateHooks forgets the Rhine gamestate hooks of the client's hooks and
+// C_WaitFor requests on a user without unhooking them, as Rhine blocks unhooks
+// until the game state is loaded. Used for modules that shut down before their
+// game state was loaded, the game state is discarded along with its hooks.
+func (c *Client) dropStateHooks(user string) {
+	for _, hook := range c.hooks {
+		if hook.user == user && hook.kind == gameStateHook {
+			hook.hook = nil
+		}
 	}
-	c.hooks[c.hookCounter] = &clientHook{
-		kind:   data.Kind,
-		target: data.Target,
-		event:  data.Event,
-		hook:   hook,
+	for w := range c.waits {
+		if w.hook.user == user && w.hook.kind == gameStateHook {
+			w.hook.hook = nil
+		}
 	}
+}
+
+// registerHooks registers the client's hooks on a user on the RhineModule of
+// the client's attachment to the user, and returns the hooks that couldn't be
+// registered. Delta and previous gamestate hooks are marked stale until the
+// user's game state is loaded.
+func (c *Client) registerHooks(a *attachment) []*clientHook {
+	var failed []*clientHook
+	for _, hook := range c.sortedHooks() {
+		if hook.user != a.user {
+			continue
+		}
+		if err := hook.register(a.mod); err != nil {
+			c.ange.Warnln("[Ange] ", err)
+			failed = append(failed, hook)
+			continue
+		}
+		hook.stale = hook.kind == gameStateHook && !hook.event && (hook.delta || hook.prev)
+	}
+	return failed
+}
 
-	ret, err := msg.ServerHooked(c.hookCounter, data.Kind, data.Target, data.Event)
+// stateReady returns an error if the game state of an attachment's user is
+// still loading, as StateGet would block the hub until it is.
+func (c *Client) stateReady(a *attachment) error {
+	mod := c.ange.modules[a.user]
+	if mod == nil || mod.RhineModule != a.mod || !mod.isReady() {
+		return newError(msg.CodeNotReady, "The game state of %s is still loading", a.user)
+	}
+	return nil
+}
+
+// prepareHook creates a hook on the user of an attachment and registers it on
+// the user's RhineModule, along with the current value at the target for
+// immediate hooks. The hook must then either be started or unhooked.
+func (c *Client) prepareHook(a *attachment, n uint64, data *msg.Hook) (*clientHook, interface{}, error) {
+	ch, err := newClientHook(c, n, a.user, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if data.Immediate {
+		if err := c.stateReady(a); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := ch.register(a.mod); err != nil {
+		ch.Unhook()
+		return nil, nil, err
+	}
+	var current interface{}
+	if data.Immediate {
+		// Events queued before the value is read are older than it, while
+		// later events are kept and may repeat it. Rhine adds the hook
+		// asynchronously, so a change made after the value is read but before
+		// the hook is in place is missed until the next change at the target.
+		ch.drain()
+		val, err := a.mod.StateGet(data.Target)
+		if err != nil {
+			ch.Unhook()
+			return nil, nil, wrapError(msg.CodeStatePathNotFound, err)
+		}
+		current = val
+	}
+	return ch, current, nil
+}
+
+// startHook sends the current value of an immediate hook and starts forwarding
+// its events, it must only be called after S_Hooked is sent.
+func (c *Client) startHook(ch *clientHook, current interface{}) {
+	if ch.spec.Immediate {
+		ch.sendCurrent(current)
+	}
+	go ch.run()
+}
+
+func (c *Client) addHook(a *attachment, data *msg.Hook) error {
+	ch, current, err := c.prepareHook(a, c.hookCounter, data)
 	if err != nil {
 		return err
 	}
+	c.hooks[ch.id] = ch
 	c.hookCounter++
-	c.sendWrapper(ret)
-	return nil
-}
 
-func (c *Client) hookHandler(op string, data []byte, pktCtx *goproxy.ProxyCtx) []byte {
-	b, err := msg.ServerHookEvt(packetHook, op, json.RawMessage(data))
+	ret, err := msg.ServerHooked(ch.hooked())
 	if err != nil {
-		c.ange.Warnln("[Ange] ", err)
-		return data
+		return err
 	}
-	c.sendWrapper(b)
-	return data
+	c.reply(ret)
+	c.startHook(ch, current)
+	return nil
 }
 
-func (c *Client) stateListener() {
-	for {
-		l, open := <-c.listener
-		if !open {
-			return
+// addHooks registers a list of hooks, none of the hooks are registered if any of
+// them is invalid.
+func (c *Client) addHooks(hooks []*msg.Hook) error {
+	prepared := make([]*clientHook, 0, len(hooks))
+	currents := make([]interface{}, 0, len(hooks))
+	ids := make(map[string]bool)
+	for i, data := range hooks {
+		a, err := c.module(data.User)
+		var ch *clientHook
+		var current interface{}
+		if data.ID != "" {
+			if ids[data.ID] {
+				err = newError(msg.CodeDuplicateHookID, "Hook ID '%s' is already in use", data.ID)
+			}
+			ids[data.ID] = true
+		}
+		if err == nil {
+			ch, current, err = c.prepareHook(a, c.hookCounter+uint64(i), data)
 		}
-		b, err := msg.ServerHookEvt(gameStateHook, l.Path, l.Payload)
 		if err != nil {
-			c.ange.Warnln("[Ange] ", err)
-			continue
+			for _, ch := range prepared {
+				ch.Unhook()
+			}
+			return newError(errorCode(err), "Hook %d: %s", i, err)
 		}
-		c.sendWrapper(b)
+		prepared = append(prepared, ch)
+		currents = append(currents, current)
+	}
+	hooked := make([]*msg.Hooked, 0, len(prepared))
+	for _, ch := range prepared {
+		c.hooks[ch.id] = ch
+		hooked = append(hooked, ch.hooked())
 	}
+	c.hookCounter += uint64(len(prepared))
+
+	ret, err := msg.ServerHookedMany(hooked)
+	if err != nil {
+		return err
+	}
+	c.reply(ret)
+	for i, ch := range prepared {
+		c.startHook(ch, currents[i])
+	}
+	return nil
+}
+
+// close stops the writePump, must only be called once by the hub.
+func (c *Client) close() {
+	close(c.quit)
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -170,28 +575,15 @@ func (c *Client) writePump() {
 	}()
 	for {
 		select {
-		case message, ok := <-c.send:
-			if !ok {
-				// The hub closed the channel.
-				return
-			}
-			err := c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err != nil {
-				c.ange.Warnln("[Ange] ", err)
-				continue
-			}
-
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
+		case <-c.quit:
+			// The hub closed the channel.
+			return
+		case message := <-c.send:
+			if !c.write(message) {
 				return
 			}
-			_, err = w.Write(message)
-			if err != nil {
-				c.ange.Warnln("[Ange] ", err)
-				continue
-			}
-
-			if err := w.Close(); err != nil {
+		case message := <-c.chunks:
+			if !c.write(message) {
 				return
 			}
 		case <-ticker.C:
@@ -207,6 +599,28 @@ func (c *Client) writePump() {
 	}
 }
 
+// write writes a message to the websocket connection, it returns false if the
+// connection should be closed.
+func (c *Client) write(message []byte) bool {
+	err := c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if err != nil {
+		c.ange.Warnln("[Ange] ", err)
+		return true
+	}
+
+	w, err := c.conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return false
+	}
+	_, err = w.Write(message)
+	if err != nil {
+		c.ange.Warnln("[Ange] ", err)
+		return true
+	}
+
+	return w.Close() == nil
+}
+
 // ServeWs handles websocket requests from the peer.
 func (ange *Ange) ServeWs(w http.ResponseWriter, r *http.Request) {
 	conn, err := ange.upgrader.Upgrade(w, r, nil)
@@ -215,15 +629,17 @@ func (ange *Ange) ServeWs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	client := &Client{
-		ange:     ange,
-		hooks:    make(map[uint64]*clientHook),
-		listener: make(chan gamestate.StateEvent, 32),
-		conn:     conn,
-		send:     make(chan []byte, 128),
+		ange:   ange,
+		hooks:  make(map[string]*clientHook),
+		waits:  make(map[*waiter]bool),
+		conn:   conn,
+		send:   make(chan []byte, 128),
+		chunks: make(chan []byte),
+		quit:   make(chan struct{}),
 	}
+	client.sess = newSession(ange, client)
 	client.ange.register <- client
 
-	go client.stateListener()
 	go client.writePump()
 	go client.readPump()
 }
@@ -1,8 +1,8 @@
 package server
 
 import (
-	"fmt"
-	"strconv"
+	"sort"
+	"strings"
 
 	"github.com/kyoukaya/angelina/server/msg"
 )
@@ -10,92 +10,305 @@ import (
 type clientMessageHandler func(h *Ange, client *Client, payload []byte) error
 
 var clientHandlerMap = map[string]clientMessageHandler{
-	"C_Attach": handleCAttach,
-	"C_Detach": handleCDetach,
-	"C_Get":    handleCGet,
-	"C_Hook":   handleCHook,
-	"C_Unhook": handleCUnhook,
+	"C_Hello":     handleCHello,
+	"C_Attach":    handleCAttach,
+	"C_Detach":    handleCDetach,
+	"C_Get":       handleCGet,
+	"C_GetMany":   handleCGetMany,
+	"C_Hook":      handleCHook,
+	"C_Unhook":    handleCUnhook,
+	"C_Resume":    handleCResume,
+	"C_ListUsers": handleCListUsers,
+	"C_ListHooks": handleCListHooks,
+	"C_HookMany":  handleCHookMany,
+	"C_UnhookAll": handleCUnhookAll,
+	"C_WaitFor":   handleCWaitFor,
+	"C_Keys":      handleCKeys,
+	"C_GameData":  handleCGameData,
 }
 
-func handleCAttach(h *Ange, client *Client, payload []byte) error {
-	id, err := msg.UnmarshalClientAttach(payload)
+// Optional protocol features supported by the server that clients may request
+// in C_Hello.
+var serverFeatures = []string{"resume", "user_info"}
+
+// Sorted list of opcodes accepted by the server, populated on init as the
+// handler map can't be referenced from the handlers themselves.
+var opcodes []string
+
+func init() {
+	for op := range clientHandlerMap {
+		opcodes = append(opcodes, op)
+	}
+	sort.Strings(opcodes)
+}
+
+func handleCHello(h *Ange, client *Client, payload []byte) error {
+	hello, err := msg.UnmarshalClientHello(payload)
 	if err != nil {
-		return err
+		return wrapError(msg.CodeBadPayload, err)
 	}
+	client.name = hello.Name
+	client.features = make(map[string]bool)
+	enabled := make([]string, 0, len(hello.Features))
+	for _, feature := range serverFeatures {
+		for _, requested := range hello.Features {
+			if feature == requested {
+				client.features[feature] = true
+				enabled = append(enabled, feature)
+				break
+			}
+		}
+	}
+	h.Printf("[Ange] %p identified as '%s' using protocol %d", client, hello.Name, hello.Protocol)
 
-	if client.mod != nil {
-		return fmt.Errorf("Client is already connected to user '%s'", getModIdentifier(client.mod))
+	ret, err := msg.ServerHello(&msg.HelloInfo{
+		Protocol:  msg.ProtocolVersion,
+		Version:   Version,
+		Opcodes:   opcodes,
+		HookTypes: []string{gameStateHook, packetHook},
+		Region:    gameDataRegion,
+		Features:  serverFeatures,
+		Enabled:   enabled,
+	})
+	if err != nil {
+		return err
 	}
+	client.reply(ret)
+	if client.features["resume"] {
+		ret, err = msg.ServerSession(client.sess.token, sessionGrace)
+		if err != nil {
+			return err
+		}
+		client.reply(ret)
+	}
+	return nil
+}
 
-	mod, exists := h.modules[id]
-	if !exists {
-		return fmt.Errorf("User '%s' is not connected", id)
+func handleCAttach(h *Ange, client *Client, payload []byte) error {
+	data, err := msg.UnmarshalClientAttach(payload)
+	if err != nil {
+		return wrapError(msg.CodeBadPayload, err)
 	}
+	id := data.User
 
-	client.mod = mod.RhineModule
-	h.attachedClients[id] = append(h.attachedClients[id], client)
+	switch {
+	case id == msg.AttachLatest:
+		if data.Sticky {
+			return newError(msg.CodeBadPayload, "Attachments made by '%s' can't be sticky", id)
+		}
+	case id == msg.AttachAny:
+	case strings.HasPrefix(id, "@"):
+		return newError(msg.CodeBadPayload, "Unknown attach policy '%s'", id)
+	default:
+		if client.attachment(id) != nil {
+			return newError(msg.CodeAlreadyAttached,
+				"Client is already attached to user '%s'", id)
+		}
+		if _, exists := h.modules[id]; !exists && !data.Wait {
+			return newError(msg.CodeUnknownUser, "User '%s' is not connected", id)
+		}
+	}
+	if id != msg.AttachAny && client.pendingAttach(id) != -1 {
+		return newError(msg.CodeAlreadyAttached, "Client is already waiting to attach to '%s'", id)
+	}
 
-	ret, err := msg.ServerAttached(id)
+	attached := h.applyAttach(client, data)
+	if !attached || id == msg.AttachLatest {
+		client.pending = append(client.pending, data)
+	}
+	if attached {
+		return nil
+	}
+	ret, err := msg.ServerAttachPending(id)
 	if err != nil {
 		return err
 	}
-	client.sendWrapper(ret)
+	client.reply(ret)
 	return nil
 }
 
 func handleCDetach(h *Ange, client *Client, payload []byte) error {
-	if client.mod == nil {
-		return fmt.Errorf("Client was not attached")
+	user, err := msg.UnmarshalClientDetach(payload)
+	if err != nil {
+		return wrapError(msg.CodeBadPayload, err)
+	}
+	if len(client.attachments) == 0 && len(client.pending) == 0 {
+		return newError(msg.CodeNotAttached, "Client was not attached")
+	}
+	if user == "" {
+		// Cancel every pending attach request and detach from every user.
+		pending := client.pending
+		client.pending = nil
+		for _, req := range pending {
+			h.sendDetached(client, req.User)
+		}
+		for _, user := range client.users() {
+			h.detachClient(client, user)
+			h.sendDetached(client, user)
+		}
+		return nil
+	}
+	if i := client.pendingAttach(user); i != -1 {
+		client.pending = append(client.pending[:i], client.pending[i+1:]...)
+		if user == msg.AttachLatest {
+			h.detachLatest(client)
+		}
+		h.sendDetached(client, user)
+		return nil
+	}
+	if client.attachment(user) == nil {
+		return newError(msg.CodeNotAttached, "Client was not attached to user '%s'", user)
+	}
+	h.detachClient(client, user)
+	h.sendDetached(client, user)
+	return nil
+}
+
+func handleCGet(h *Ange, client *Client, payload []byte) error {
+	get, err := msg.UnmarshalClientGet(payload)
+	if err != nil {
+		return wrapError(msg.CodeBadPayload, err)
+	}
+	if get.ChunkBytes < 0 {
+		return newError(msg.CodeBadPayload, "Invalid chunk_bytes %d", get.ChunkBytes)
+	}
+	if get.Stream && client.reqID == "" {
+		// Chunks of concurrent streams could otherwise not be told apart.
+		return newError(msg.CodeBadPayload, "Streamed requests require a request ID")
 	}
-	h.detachClient(client)
-	ret, err := msg.ServerDetach()
+	val, next, err := client.get(get)
 	if err != nil {
 		return err
 	}
-	client.sendWrapper(ret)
+	if get.Stream {
+		client.stream(get, val, next, payload)
+		return nil
+	}
+	ret, err := msg.ServerGet(get.Path, val, next)
+	if err != nil {
+		return err
+	}
+	client.reply(ret)
 	return nil
 }
 
-func handleCGet(h *Ange, client *Client, payload []byte) error {
-	if client.mod == nil {
-		return fmt.Errorf("Client is not attached")
+func handleCGetMany(h *Ange, client *Client, payload []byte) error {
+	gets, aliases, err := msg.UnmarshalClientGetMany(payload)
+	if err != nil {
+		return wrapError(msg.CodeBadPayload, err)
+	}
+	result := func(get *msg.Get) *msg.GetResult {
+		val, next, err := client.get(get)
+		if err == nil && get.Stream {
+			err = newError(msg.CodeBadPayload, "C_GetMany replies can't be streamed")
+		}
+		if err != nil {
+			return &msg.GetResult{
+				Path:  get.Path,
+				Error: &msg.ErrorInfo{Code: errorCode(err), Error: err.Error()},
+			}
+		}
+		return &msg.GetResult{Path: get.Path, Data: val, Next: next}
+	}
+	var ret []byte
+	if aliases != nil {
+		results := make(map[string]*msg.GetResult, len(aliases))
+		for alias, get := range aliases {
+			results[alias] = result(get)
+		}
+		ret, err = msg.ServerGetMany(results)
+	} else {
+		results := make([]*msg.GetResult, 0, len(gets))
+		for _, get := range gets {
+			results = append(results, result(get))
+		}
+		ret, err = msg.ServerGetMany(results)
 	}
-	path, err := msg.UnmarshalClientGet(payload)
 	if err != nil {
 		return err
 	}
-	val, err := client.mod.StateGet(path)
+	client.reply(ret)
+	return nil
+}
+
+func handleCKeys(h *Ange, client *Client, payload []byte) error {
+	req, err := msg.UnmarshalClientKeys(payload)
+	if err != nil {
+		return wrapError(msg.CodeBadPayload, err)
+	}
+	keys, err := client.keys(req)
 	if err != nil {
 		return err
 	}
-	ret, err := msg.ServerGet(path, val)
+	ret, err := msg.ServerKeys(keys)
 	if err != nil {
 		return err
 	}
-	client.sendWrapper(ret)
+	client.reply(ret)
 	return nil
 }
 
-func handleCHook(h *Ange, client *Client, payload []byte) error {
-	if client.mod == nil {
-		return fmt.Errorf("Client is not attached")
+func handleCGameData(h *Ange, client *Client, payload []byte) error {
+	req, err := msg.UnmarshalClientGameData(payload)
+	if err != nil {
+		return wrapError(msg.CodeBadPayload, err)
 	}
-	data, err := msg.UnmarshalClientHook(payload)
+	data, err := h.lookupGameData(req)
 	if err != nil {
 		return err
 	}
-	return client.addHook(data)
+	ret, err := msg.ServerGameData(&msg.GameDataResult{
+		Table:  req.Table,
+		ID:     req.ID,
+		Search: req.Search,
+		Data:   data,
+	})
+	if err != nil {
+		return err
+	}
+	client.reply(ret)
+	return nil
 }
 
-func handleCUnhook(h *Ange, client *Client, payload []byte) error {
-	idStr, err := msg.UnmarshalClientUnhook(payload)
+func handleCHook(h *Ange, client *Client, payload []byte) error {
+	data, err := msg.UnmarshalClientHook(payload)
+	if err != nil {
+		return wrapError(msg.CodeBadPayload, err)
+	}
+	a, err := client.module(data.User)
 	if err != nil {
 		return err
 	}
-	id, err := strconv.ParseUint(idStr, 10, 64)
+	return client.addHook(a, data)
+}
+
+func handleCHookMany(h *Ange, client *Client, payload []byte) error {
+	hooks, err := msg.UnmarshalClientHookMany(payload)
+	if err != nil {
+		return wrapError(msg.CodeBadPayload, err)
+	}
+	return client.addHooks(hooks)
+}
+
+func handleCListHooks(h *Ange, client *Client, payload []byte) error {
+	hooks := client.sortedHooks()
+	specs := make([]*msg.Hook, 0, len(hooks))
+	for _, hook := range hooks {
+		specs = append(specs, &hook.spec)
+	}
+	ret, err := msg.ServerHookList(specs)
 	if err != nil {
 		return err
 	}
+	client.reply(ret)
+	return nil
+}
+
+func handleCUnhook(h *Ange, client *Client, payload []byte) error {
+	id, err := msg.UnmarshalClientUnhook(payload)
+	if err != nil {
+		return wrapError(msg.CodeBadPayload, err)
+	}
 	err = client.removeHook(id)
 	if err != nil {
 		return err
@@ -104,6 +317,64 @@ func handleCUnhook(h *Ange, client *Client, payload []byte) error {
 	if err != nil {
 		return err
 	}
-	client.sendWrapper(ret)
+	client.reply(ret)
+	return nil
+}
+
+func handleCUnhookAll(h *Ange, client *Client, payload []byte) error {
+	data, err := msg.UnmarshalClientUnhookAll(payload)
+	if err != nil {
+		return wrapError(msg.CodeBadPayload, err)
+	}
+	ids := []string{}
+	for _, hook := range client.sortedHooks() {
+		if (data.User == "" || hook.user == data.User) && (data.Tag == "" || hook.tag == data.Tag) {
+			hook.Unhook()
+			delete(client.hooks, hook.id)
+			ids = append(ids, hook.id)
+		}
+	}
+	ret, err := msg.ServerUnhookedAll(ids)
+	if err != nil {
+		return err
+	}
+	client.reply(ret)
+	return nil
+}
+
+func handleCWaitFor(h *Ange, client *Client, payload []byte) error {
+	data, err := msg.UnmarshalClientWaitFor(payload)
+	if err != nil {
+		return wrapError(msg.CodeBadPayload, err)
+	}
+	a, err := client.module(data.User)
+	if err != nil {
+		return err
+	}
+	return client.waitFor(a, data)
+}
+
+func handleCResume(h *Ange, client *Client, payload []byte) error {
+	data, err := msg.UnmarshalClientResume(payload)
+	if err != nil {
+		return wrapError(msg.CodeBadPayload, err)
+	}
+	old, exists := h.sessions[data.Token]
+	if !exists || old == client {
+		return newError(msg.CodeUnknownSession, "Session '%s' does not exist or has expired", data.Token)
+	}
+	if len(client.attachments) > 0 || len(client.pending) > 0 || len(client.hooks) > 0 {
+		return newError(msg.CodeAlreadyAttached, "Client must not be attached to resume a session")
+	}
+	h.resumeSession(client, old, data.LastSeq)
+	return nil
+}
+
+func handleCListUsers(h *Ange, client *Client, payload []byte) error {
+	ret, err := h.userList(client)
+	if err != nil {
+		return err
+	}
+	client.reply(ret)
 	return nil
 }
@@ -0,0 +1,28 @@
+package server
+
+import "testing"
+
+func TestRootKeys(t *testing.T) {
+	all := rootKeys("")
+	if all.Type != "object" || all.Size == nil || *all.Size != len(all.Keys) {
+		t.Fatalf("rootKeys(\"\") = %+v, expected an object with a size of %d", all.KeyInfo, len(all.Keys))
+	}
+	types := make(map[string]string)
+	for i, k := range all.Keys {
+		if i > 0 && all.Keys[i-1].Key.(string) >= k.Key.(string) {
+			t.Errorf("Key %v is out of order", k.Key)
+		}
+		if k.Size != nil {
+			t.Errorf("Key %v has a size", k.Key)
+		}
+		types[k.Key.(string)] = k.Type
+	}
+	for key, want := range map[string]string{"status": "object", "troop": "object", "inventory": "object"} {
+		if types[key] != want {
+			t.Errorf("Type of %s = %q, expected %q", key, types[key], want)
+		}
+	}
+	if keys := rootKeys("tr").Keys; len(keys) != 1 || keys[0].Key != "troop" {
+		t.Errorf("rootKeys(\"tr\") = %v, expected troop", keys)
+	}
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/kyoukaya/angelina/server/msg"
+)
+
+// angeError is an error that is reported to the client along with an error code.
+type angeError struct {
+	code msg.ErrorCode
+	err  string
+}
+
+func (e *angeError) Error() string {
+	return e.err
+}
+
+// newError formats an error that will be reported to the client with the code.
+func newError(code msg.ErrorCode, format string, a ...interface{}) error {
+	return &angeError{code, fmt.Sprintf(format, a...)}
+}
+
+// wrapError attaches an error code to an existing error.
+func wrapError(code msg.ErrorCode, err error) error {
+	return &angeError{code, err.Error()}
+}
+
+// errorCode returns the code of the error, errors without a code are
+// considered internal errors.
+func errorCode(err error) msg.ErrorCode {
+	if e, ok := err.(*angeError); ok {
+		return e.code
+	}
+	return msg.CodeInternal
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kyoukaya/rhine/utils"
+
+	"github.com/kyoukaya/angelina/server/msg"
+	"github.com/kyoukaya/angelina/server/query"
+)
+
+// Locale of the tables downloaded by rhine's gamedata package for each region.
+var gameDataLocales = map[string]string{
+	"GL": "en_US",
+	"JP": "ja_JP",
+	"KR": "ko_KR",
+}
+
+// gameTableNames lists the game data tables that may be requested with
+// C_GameData, along with the fields of their entries matched by searches.
+// rhine's gamedata package only parses the item and stage tables, the
+// operators and gacha tables are read from the files it downloads. Skills are
+// not supported as rhine doesn't download skill_table.
+var gameTableNames = map[string][]string{
+	"items":       {"name"},
+	"stages":      {"code", "name"},
+	"operators":   {"name", "appellation"},
+	"gacha_tags":  {"tagName"},
+	"gacha_pools": {"gachaPoolName"},
+}
+
+// gameTable is a normalized game data table mapping IDs to entries.
+type gameTable map[string]interface{}
+
+// loadGameData loads the game data tables in the background, as rhine may still
+// be downloading them, and closes gameDataReady once done. Tables that fail to
+// load are left nil.
+func (ange *Ange) loadGameData() {
+	defer close(ange.gameDataReady)
+	// rhine's gamedata package panics if a table is missing.
+	defer func() {
+		if r := recover(); r != nil {
+			ange.Warnln("[Ange] Failed to load game data: ", r)
+		}
+	}()
+	tables := ange.gameTables
+	// GetItemInfo blocks until rhine is done updating the tables.
+	items, err := ange.gamedata.GetItemInfo()
+	if err != nil {
+		ange.Warnln("[Ange] ", err)
+		return
+	}
+	tables["items"] = ange.normalizeTable(items.Items)
+	stages, err := ange.gamedata.GetStageInfo()
+	if err != nil {
+		ange.Warnln("[Ange] ", err)
+		return
+	}
+	tables["stages"] = ange.normalizeTable(stages.Stages)
+	tables["operators"] = ange.normalizeTable(ange.readExcel("character_table"))
+	gacha := ange.normalizeTable(ange.readExcel("gacha_table"))
+	tags, _ := gacha["gachaTags"].([]interface{})
+	tables["gacha_tags"] = tableByField(tags, "tagId")
+	pools, _ := gacha["gachaPoolClient"].([]interface{})
+	tables["gacha_pools"] = tableByField(pools, "gachaPoolId")
+}
+
+// readExcel reads an excel table downloaded by rhine, nil is returned if it
+// can't be read.
+func (ange *Ange) readExcel(table string) json.RawMessage {
+	b, err := ioutil.ReadFile(fmt.Sprintf("%sdata/%s/gamedata/excel/%s.json",
+		utils.BinDir, gameDataLocales[gameDataRegion], table))
+	if err != nil {
+		ange.Warnln("[Ange] ", err)
+		return nil
+	}
+	return b
+}
+
+// normalizeTable converts a table into a gameTable, nil is returned if it isn't
+// an object.
+func (ange *Ange) normalizeTable(v interface{}) gameTable {
+	if raw, ok := v.(json.RawMessage); ok && raw == nil {
+		return nil
+	}
+	norm, err := query.Normalize(v)
+	if err != nil {
+		ange.Warnln("[Ange] ", err)
+		return nil
+	}
+	table, _ := norm.(map[string]interface{})
+	return table
+}
+
+// tableByField creates a gameTable from a list of entries using a field of the
+// entries as their ID.
+func tableByField(entries []interface{}, field string) gameTable {
+	if entries == nil {
+		return nil
+	}
+	table := make(gameTable, len(entries))
+	for _, entry := range entries {
+		obj, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		switch id := obj[field].(type) {
+		case string:
+			table[id] = entry
+		case float64:
+			table[strconv.FormatFloat(id, 'f', -1, 64)] = entry
+		}
+	}
+	return table
+}
+
+// search returns the entries of a table whose ID or name fields contain a
+// term, ignoring case.
+func (t gameTable) search(term string, names []string) gameTable {
+	term = strings.ToLower(term)
+	ret := make(gameTable)
+	for id, entry := range t {
+		if strings.Contains(strings.ToLower(id), term) {
+			ret[id] = entry
+			continue
+		}
+		obj, _ := entry.(map[string]interface{})
+		for _, name := range names {
+			if s, ok := obj[name].(string); ok && strings.Contains(strings.ToLower(s), term) {
+				ret[id] = entry
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// lookupGameData answers a C_GameData request without blocking the hub, an
+// error is returned while the tables are loading.
+func (ange *Ange) lookupGameData(req *msg.GameData) (interface{}, error) {
+	names, ok := gameTableNames[req.Table]
+	if !ok {
+		tables := make([]string, 0, len(gameTableNames))
+		for name := range gameTableNames {
+			tables = append(tables, name)
+		}
+		sort.Strings(tables)
+		return nil, newError(msg.CodeUnknownTable, "Unknown game data table '%s', expected one of %s",
+			req.Table, strings.Join(tables, ", "))
+	}
+	select {
+	case <-ange.gameDataReady:
+	default:
+		return nil, newError(msg.CodeGameDataLoading, "Game data is still loading")
+	}
+	table := ange.gameTables[req.Table]
+	if table == nil {
+		return nil, newError(msg.CodeInternal, "Game data table '%s' failed to load", req.Table)
+	}
+	projection, err := query.NewProjection(req.Fields)
+	if err != nil {
+		return nil, wrapError(msg.CodeBadPayload, err)
+	}
+	if req.ID != "" {
+		if req.Search != "" || req.Where != "" || len(req.Sort) > 0 || req.Limit != 0 {
+			return nil, newError(msg.CodeBadPayload, "Entries requested by ID can't be searched or queried")
+		}
+		entry, ok := table[req.ID]
+		if !ok {
+			return nil, newError(msg.CodeGameDataNotFound, "Unable to find '%s' in %s", req.ID, req.Table)
+		}
+		if len(projection) > 0 {
+			return projection.Apply(entry), nil
+		}
+		return entry, nil
+	}
+	if req.Search != "" {
+		table = table.search(req.Search, names)
+	}
+	return runQuery(req.Where, req.Sort, req.Limit, projection, map[string]interface{}(table))
+}
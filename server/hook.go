@@ -1,17 +1,475 @@
 package server
 
-import "github.com/kyoukaya/rhine/proxy"
+import (
+	"encoding/json"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/kyoukaya/rhine/proxy"
+	"github.com/kyoukaya/rhine/proxy/gamestate"
+
+	"github.com/kyoukaya/angelina/server/msg"
+	"github.com/kyoukaya/angelina/server/query"
+)
 
 type clientHook struct {
+	id     string // Chosen by the client or generated from n
+	n      uint64 // Order the hook was registered in
+	tag    string
 	kind   string // 'gamestate' or 'packet'
 	target string
 	event  bool
-	hook   proxy.Hooker
+	user   string // Identifier of the user the hook is registered on
+	glob   bool   // Packet target is a pattern matched against every packet op
+	filter *query.Expr
+	fields query.Projection
+	delta  bool
+	prev   bool
+	// Minimum interval between events and quiet period before events are sent,
+	// only one of them may be set.
+	throttle time.Duration
+	debounce time.Duration
+	// Number of events and time after which the hook expires, if set.
+	maxEvents int
+	ttl       time.Duration
+	hook      proxy.Hooker
+	sess      *session
+	// Request the hook was registered with, reported by C_ListHooks.
+	spec msg.Hook
+	// Set on delta and previous gamestate hooks registered again after their
+	// user reconnected, until the new game state is loaded. Only accessed from
+	// the hub.
+	stale bool
+
+	// Events from Rhine are queued in listener and forwarded to the client by
+	// run, packet events are converted to StateEvents with the op as the path.
+	listener chan gamestate.StateEvent
+	// Closed when the hook is unhooked to stop run.
+	done chan struct{}
+
+	// Last value sent to the client and the number of events sent, only
+	// accessed from run and sendCurrent.
+	last     interface{}
+	lastSent bool
+	events   int
+}
+
+// hookExpiry is sent to the hub when a hook reaches its event limit or TTL.
+type hookExpiry struct {
+	token  string // Token of the session the hook belongs to
+	hook   *clientHook
+	reason string
 }
 
 const gameStateHook = "gamestate"
 const packetHook = "packet"
 
+// Number of events that may be queued for a hook before they are dropped.
+const hookQueueSiz = 32
+
+// Maximum number of packets sent in a batch by a throttled or debounced hook,
+// the batch is sent early if it's full.
+const maxBatchSiz = 64
+
+// Rhine target that receives every packet.
+const allPackets = "*"
+
+// isGlob reports whether a packet hook target is a pattern rather than an op.
+func isGlob(target string) bool {
+	return strings.ContainsAny(target, "*?[")
+}
+
+// matchTarget reports whether a packet op matches a glob target. Targets ending
+// with '*' match every op with the same prefix, e.g., 'S/gacha/*' matches
+// 'S/gacha/syncNormalGacha', other patterns are matched with path.Match.
+func matchTarget(target, op string) bool {
+	if prefix := strings.TrimSuffix(target, "*"); !isGlob(prefix) {
+		return strings.HasPrefix(op, prefix)
+	}
+	matched, _ := path.Match(target, op)
+	return matched
+}
+
+func newClientHook(c *Client, n uint64, user string, data *msg.Hook) (*clientHook, error) {
+	id := data.ID
+	if id == "" {
+		id = strconv.FormatUint(n, 10)
+	} else if _, err := strconv.ParseUint(id, 10, 64); err == nil {
+		return nil, newError(msg.CodeBadPayload, "Hook ID '%s' is reserved, numeric IDs are generated by the server", id)
+	} else if c.hooks[id] != nil {
+		return nil, newError(msg.CodeDuplicateHookID, "Hook ID '%s' is already in use", id)
+	}
+	switch data.Kind {
+	case packetHook:
+		if _, err := path.Match(data.Target, ""); err != nil {
+			return nil, newError(msg.CodeBadPayload, "Invalid target pattern '%s'", data.Target)
+		}
+	case gameStateHook:
+	default:
+		return nil, newError(msg.CodeUnknownHookType, "Unknown hook type '%s'", data.Kind)
+	}
+	ch := &clientHook{
+		id:       id,
+		n:        n,
+		tag:      data.Tag,
+		kind:     data.Kind,
+		target:   data.Target,
+		event:    data.Event,
+		user:     user,
+		glob:     data.Kind == packetHook && isGlob(data.Target),
+		sess:     c.sess,
+		listener: make(chan gamestate.StateEvent, hookQueueSiz),
+		done:     make(chan struct{}),
+		spec:     *data,
+	}
+	ch.spec.ID = id
+	ch.spec.User = user
+	if data.Filter != "" {
+		filter, err := query.Parse(data.Filter)
+		if err != nil {
+			return nil, newError(msg.CodeBadPayload, "Invalid filter: %s", err)
+		}
+		ch.filter = filter
+	}
+	fields, err := query.NewProjection(data.Fields)
+	if err != nil {
+		return nil, wrapError(msg.CodeBadPayload, err)
+	}
+	if len(fields) > 0 {
+		ch.fields = fields
+	}
+	if data.Delta {
+		if data.Kind != gameStateHook || data.Event {
+			return nil, newError(msg.CodeBadPayload, "Delta mode is only supported on gamestate hooks with data")
+		}
+		ch.delta = true
+	}
+	if data.Immediate && data.Kind != gameStateHook {
+		return nil, newError(msg.CodeBadPayload, "Immediate is only supported on gamestate hooks")
+	}
+	if data.Previous {
+		if data.Kind != gameStateHook || data.Event {
+			return nil, newError(msg.CodeBadPayload, "Previous values are only supported on gamestate hooks with data")
+		}
+		ch.prev = true
+	}
+	if data.ThrottleMS < 0 || data.DebounceMS < 0 || (data.ThrottleMS > 0 && data.DebounceMS > 0) {
+		return nil, newError(msg.CodeBadPayload, "Only one of throttle_ms or debounce_ms may be set")
+	}
+	ch.throttle = time.Duration(data.ThrottleMS) * time.Millisecond
+	ch.debounce = time.Duration(data.DebounceMS) * time.Millisecond
+	if data.MaxEvents < 0 || data.TTLMS < 0 || (data.Once && data.MaxEvents > 0) {
+		return nil, newError(msg.CodeBadPayload, "Only one of once or max_events may be set")
+	}
+	ch.maxEvents = data.MaxEvents
+	if data.Once {
+		ch.maxEvents = 1
+	}
+	ch.ttl = time.Duration(data.TTLMS) * time.Millisecond
+	return ch, nil
+}
+
+// hooked returns the description of the hook sent in S_Hooked.
+func (ch *clientHook) hooked() *msg.Hooked {
+	return &msg.Hooked{
+		ID:     ch.id,
+		Tag:    ch.tag,
+		User:   ch.user,
+		Kind:   ch.kind,
+		Target: ch.target,
+		Event:  ch.event,
+	}
+}
+
+// register hooks onto a RhineModule, the hook may be registered again after
+// being unregistered when the user reconnects.
+func (ch *clientHook) register(mod *proxy.RhineModule) error {
+	switch ch.kind {
+	case packetHook:
+		target := ch.target
+		if ch.glob {
+			target = allPackets
+		}
+		ch.hook = mod.Hook(target, 0, ch.packetHandler)
+	case gameStateHook:
+		hook := mod.StateHook(ch.target, ch.listener, ch.event)
+		if h, ok := hook.(*gamestate.GameStateHook); ok && h == nil {
+			// Rhine's queue of hooks is full, and unhooking a nil
+			// GameStateHook panics.
+			return newError(msg.CodeInternal, "Failed to register gamestate hook on %s", ch.target)
+		}
+		ch.hook = hook
+	}
+	return nil
+}
+
+// resync queues the current value at the target of a stale hook as an event,
+// so that delta and previous values sent afterwards are relative to the game
+// state the user reconnected with. The user's game state must be loaded.
+func (ch *clientHook) resync(mod *proxy.RhineModule) {
+	ch.stale = false
+	val, err := mod.StateGet(ch.target)
+	if err != nil {
+		// The target may not exist anymore, e.g., a removed operator.
+		val = nil
+	}
+	select {
+	case ch.listener <- gamestate.StateEvent{Path: ch.target, Payload: val}:
+	default:
+		ch.sess.ange.Warnf("[Ange] Failed to resync hook %s, queue is full", ch.id)
+	}
+}
+
+// unregister removes the hook from the RhineModule it's registered on.
+func (ch *clientHook) unregister() {
+	if ch.hook != nil {
+		ch.hook.Unhook()
+		ch.hook = nil
+	}
+}
+
 func (ch *clientHook) Unhook() {
-	ch.hook.Unhook()
+	ch.unregister()
+	close(ch.done)
+}
+
+// hookData is the target and data of an event from Rhine, the data is
+// normalized if required by the hook's options.
+type hookData struct {
+	target string
+	data   interface{}
+}
+
+// run forwards events from the listener to the client until the hook is
+// unhooked. Events of throttled or debounced hooks are held in pending until
+// the timer fires, gamestate events are coalesced into the latest value while
+// packet events are sent together in a batch. Once the hook expires, events are
+// discarded until the hub unhooks it.
+func (ch *clientHook) run() {
+	var pending []hookData
+	var lastFlush time.Time
+	// timerC is nil while the timer is stopped so stale ticks are never read.
+	var timer *time.Timer
+	var timerC <-chan time.Time
+	stopTimer := func() {
+		if timer != nil {
+			timer.Stop()
+			timer, timerC = nil, nil
+		}
+	}
+	defer stopTimer()
+	var ttlC <-chan time.Time
+	if ch.ttl > 0 {
+		ttl := time.NewTimer(ch.ttl)
+		defer ttl.Stop()
+		ttlC = ttl.C
+	}
+	expired := false
+	expire := func(reason string) {
+		stopTimer()
+		expired, ttlC, pending = true, nil, nil
+		ch.expire(reason)
+	}
+	checkLimit := func() {
+		if !expired && ch.maxEvents > 0 && ch.events >= ch.maxEvents {
+			expire(msg.HookExpiredMaxEvents)
+		}
+	}
+	flush := func() {
+		stopTimer()
+		if len(pending) == 1 && ch.kind == gameStateHook {
+			ch.send(pending[0])
+		} else if len(pending) > 0 {
+			ch.sendBatch(pending)
+		}
+		pending = nil
+		lastFlush = time.Now()
+		checkLimit()
+	}
+	// The value sent by immediate hooks counts towards the limit.
+	checkLimit()
+	for {
+		select {
+		case evt := <-ch.listener:
+			if expired {
+				continue
+			}
+			d, ok := ch.accept(evt)
+			if !ok {
+				continue
+			}
+			if ch.throttle == 0 && ch.debounce == 0 {
+				ch.send(d)
+				checkLimit()
+				continue
+			}
+			if ch.kind == gameStateHook {
+				pending = append(pending[:0], d)
+			} else {
+				pending = append(pending, d)
+			}
+			switch {
+			case len(pending) >= maxBatchSiz:
+				flush()
+			case ch.debounce > 0:
+				stopTimer()
+				timer = time.NewTimer(ch.debounce)
+				timerC = timer.C
+			case timer == nil:
+				wait := ch.throttle - time.Since(lastFlush)
+				if wait <= 0 {
+					flush()
+					continue
+				}
+				timer = time.NewTimer(wait)
+				timerC = timer.C
+			}
+		case <-timerC:
+			flush()
+		case <-ttlC:
+			flush()
+			if !expired {
+				expire(msg.HookExpiredTTL)
+			}
+		case <-ch.done:
+			return
+		}
+	}
+}
+
+// expire notifies the hub that the hook has expired so that it's removed from
+// the client.
+func (ch *clientHook) expire(reason string) {
+	select {
+	case ch.sess.ange.hookExpired <- hookExpiry{ch.sess.token, ch, reason}:
+	case <-ch.done:
+	}
+}
+
+// drain discards the events queued on the hook's listener, it must be called
+// before run is started.
+func (ch *clientHook) drain() {
+	for len(ch.listener) > 0 {
+		<-ch.listener
+	}
+}
+
+// sendCurrent sends the value of the hook's target as its first event, it must
+// be called before run is started. The listener is drained before the value is
+// read, events queued since then are sent after it by run and may repeat it.
+func (ch *clientHook) sendCurrent(val interface{}) {
+	if ch.event {
+		val = nil
+	}
+	if d, ok := ch.accept(gamestate.StateEvent{Path: ch.target, Payload: val}); ok {
+		ch.send(d)
+	}
+}
+
+// accept normalizes the data of an event if the hook's options require it and
+// reports whether it passes the hook's filter. The filter is evaluated against
+// an object with the event's target and data.
+func (ch *clientHook) accept(evt gamestate.StateEvent) (hookData, bool) {
+	d := hookData{evt.Path, evt.Payload}
+	if ch.filter == nil && ch.fields == nil && !ch.delta && !ch.prev {
+		return d, true
+	}
+	norm, err := query.Normalize(evt.Payload)
+	if err != nil {
+		ch.sess.ange.Warnln("[Ange] ", err)
+		return d, false
+	}
+	d.data = norm
+	if ch.filter != nil && !ch.filter.Match(map[string]interface{}{
+		"target": evt.Path,
+		"data":   norm,
+	}) {
+		return d, false
+	}
+	return d, true
+}
+
+// send applies the hook's projection, delta mode and previous value, if any,
+// to the data of an event and sends it to the client.
+func (ch *clientHook) send(d hookData) {
+	evtMsg := ch.newEvt(d.target)
+	data := d.data
+	if ch.fields != nil && data != nil {
+		data = ch.fields.Apply(data)
+	}
+	evtMsg.Data = data
+	if ch.delta || ch.prev {
+		if ch.delta && ch.lastSent {
+			patch := query.Diff(ch.last, data)
+			if len(patch) == 0 {
+				// Events that don't change the value don't count.
+				return
+			}
+			evtMsg.Data = nil
+			evtMsg.Patch = patch
+		}
+		if ch.prev && ch.lastSent {
+			evtMsg.Prev = ch.last
+			if cur, ok := data.(float64); ok {
+				if prev, ok := ch.last.(float64); ok {
+					change := cur - prev
+					evtMsg.Change = &change
+				}
+			}
+		}
+		ch.last = data
+		ch.lastSent = true
+	}
+	ch.events++
+	ch.sess.sendHookEvt(evtMsg)
+}
+
+// sendBatch sends the events held by a throttled or debounced packet hook in a
+// single message.
+func (ch *clientHook) sendBatch(ds []hookData) {
+	// Every packet of the batch counts towards the limit.
+	if remaining := ch.maxEvents - ch.events; ch.maxEvents > 0 && len(ds) > remaining {
+		ds = ds[:remaining]
+	}
+	evtMsg := ch.newEvt(ch.target)
+	evtMsg.Batch = make([]msg.HookBatchItem, len(ds))
+	for i, d := range ds {
+		data := d.data
+		if ch.fields != nil && data != nil {
+			data = ch.fields.Apply(data)
+		}
+		evtMsg.Batch[i] = msg.HookBatchItem{Target: d.target, Data: data}
+	}
+	ch.events += len(ds)
+	ch.sess.sendHookEvt(evtMsg)
+}
+
+func (ch *clientHook) newEvt(target string) *msg.HookEvt {
+	return &msg.HookEvt{
+		ID:     ch.id,
+		Tag:    ch.tag,
+		User:   ch.user,
+		Kind:   ch.kind,
+		Target: target,
+		Time:   time.Now().UnixNano() / int64(time.Millisecond),
+	}
+}
+
+// packetHandler queues packets received by Rhine to be sent by run. The data is
+// copied as the handler returns before the event is marshalled.
+func (ch *clientHook) packetHandler(op string, data []byte, pktCtx *goproxy.ProxyCtx) []byte {
+	if ch.glob && !matchTarget(ch.target, op) {
+		return data
+	}
+	payload := make(json.RawMessage, len(data))
+	copy(payload, data)
+	select {
+	case ch.listener <- gamestate.StateEvent{Path: op, Payload: payload}:
+	default:
+		ch.sess.ange.Warnf("[Ange] Packet event for hook %s of session %s dropped", ch.id, ch.sess.token)
+	}
+	return data
 }
@@ -0,0 +1,46 @@
+package server
+
+import "testing"
+
+func TestIsGlob(t *testing.T) {
+	tests := []struct {
+		target string
+		want   bool
+	}{
+		{"S/gacha/refreshTags", false},
+		{"S/gacha/*", true},
+		{"*", true},
+		{"S/quest/battle?tart", true},
+		{"S/[a-z]/x", true},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := isGlob(test.target); got != test.want {
+			t.Errorf("isGlob(%q) = %t, expected %t", test.target, got, test.want)
+		}
+	}
+}
+
+func TestMatchTarget(t *testing.T) {
+	tests := []struct {
+		target, op string
+		want       bool
+	}{
+		{"S/gacha/*", "S/gacha/syncNormalGacha", true},
+		{"S/gacha/*", "S/gacha/", true},
+		{"S/gacha/*", "S/gachax", false},
+		{"S/*", "S/gacha/syncNormalGacha", true},
+		{"*", "C/account/login", true},
+		{"S/*/syncData", "S/account/syncData", true},
+		{"S/*/syncData", "S/account/nested/syncData", false},
+		{"S/quest/battle?tart", "S/quest/battleStart", true},
+		{"S/quest/battle?tart", "S/quest/battleFinish", false},
+		{"[SC]/building/*", "C/building/sync", true},
+		{"[SC]/building/*", "X/building/sync", false},
+	}
+	for _, test := range tests {
+		if got := matchTarget(test.target, test.op); got != test.want {
+			t.Errorf("matchTarget(%q, %q) = %t, expected %t", test.target, test.op, got, test.want)
+		}
+	}
+}
@@ -1,8 +1,7 @@
 package server
 
 import (
-	"bytes"
-	"fmt"
+	"sort"
 
 	"github.com/kyoukaya/angelina/server/msg"
 )
@@ -15,12 +14,9 @@ func (ange *Ange) runHub() {
 		// Handle new ws client connections
 		case client := <-ange.register:
 			ange.clients[client] = true
+			ange.sessions[client.sess.token] = client
 			// Build and send S_UserList
-			users := make([]string, 0, len(ange.modules))
-			for k := range ange.modules {
-				users = append(users, k)
-			}
-			res, err := msg.ServerUserList(users)
+			res, err := ange.userList(client)
 			if err != nil {
 				ange.Warnln("[Ange] ", err)
 				ange.sendErrorWrapper(client, err, []byte("register"))
@@ -31,15 +27,60 @@ func (ange *Ange) runHub() {
 		// Handle ws client disconnects
 		case client := <-ange.unregister:
 			if _, ok := ange.clients[client]; ok {
-				if client.mod != nil {
-					ange.detachClient(client)
-				}
 				delete(ange.clients, client)
-				close(client.send)
+				client.close()
+				if client.features["resume"] &&
+					(len(client.attachments) > 0 || len(client.pending) > 0 || len(client.hooks) > 0) {
+					// Keep the session for the client to resume.
+					client.sess.suspend()
+					ange.Printf("[Ange] websocket client disconnected %p, session %s suspended",
+						client, client.sess.token)
+					continue
+				}
+				ange.releaseClient(client)
+				delete(ange.sessions, client.sess.token)
 				ange.Printf("[Ange] websocket client disconnected %p", client)
 			}
+		// Handle suspended sessions that weren't resumed in time
+		case expiry := <-ange.sessionExpired:
+			client, ok := ange.sessions[expiry.token]
+			if !ok || client.sess.epoch != expiry.epoch || client.sess.client != nil {
+				// The session was resumed.
+				continue
+			}
+			ange.releaseClient(client)
+			delete(ange.sessions, expiry.token)
+			ange.Printf("[Ange] session %s expired", expiry.token)
+		// Handle hooks that reached their event limit or TTL
+		case expiry := <-ange.hookExpired:
+			client, ok := ange.sessions[expiry.token]
+			hook := expiry.hook
+			if !ok || client.hooks[hook.id] != hook {
+				// The hook was already unhooked.
+				continue
+			}
+			hook.Unhook()
+			delete(client.hooks, hook.id)
+			res, err := msg.ServerHookExpired(hook.id, hook.tag, expiry.reason)
+			if err != nil {
+				ange.Warnln("[Ange] ", err)
+				continue
+			}
+			client.sendWrapper(res)
+		// Handle C_WaitFor requests that matched an event or timed out
+		case res := <-ange.waitDone:
+			client, ok := ange.sessions[res.token]
+			if !ok || !client.waits[res.waiter] {
+				// The wait was cancelled.
+				continue
+			}
+			client.finishWait(res.waiter, res.status, res.data)
 		// Handle messages from ws clients
 		case msg := <-ange.messages:
+			if _, ok := ange.clients[msg.client]; !ok {
+				// The client's session was taken over by another connection.
+				continue
+			}
 			ange.dispatch(msg)
 		// Handle new RhineModule connection
 		case mod := <-ange.modAttach:
@@ -50,42 +91,94 @@ func (ange *Ange) runHub() {
 				ange.Warnln("[Ange] ", err)
 				continue
 			}
+			// Clients that enabled user_info are notified once the user's
+			// game state is loaded.
 			for client := range ange.clients {
-				client.sendWrapper(res)
+				if !client.features["user_info"] {
+					client.sendWrapper(res)
+				}
+			}
+			ange.reattachClients(mod)
+			ange.resolveAllPending()
+		// Handle RhineModules that finished loading their game state
+		case mod := <-ange.modReady:
+			userID := getModIdentifier(mod.RhineModule)
+			if ange.modules[userID] != mod {
+				continue
+			}
+			ange.resyncHooks(mod)
+			res, err := msg.ServerNewUserInfo(mod.info())
+			if err != nil {
+				ange.Warnln("[Ange] ", err)
+				continue
+			}
+			for client := range ange.clients {
+				if client.features["user_info"] {
+					client.sendWrapper(res)
+				}
 			}
 		// Handle new RhineModule disconnects
 		case mod := <-ange.modDetach:
 			userID := getModIdentifier(mod.RhineModule)
-			delete(ange.modules, userID)
-			detachMsg, err := msg.ServerDetach()
+			// The user may have already reconnected with a new module.
+			if ange.modules[userID] == mod {
+				delete(ange.modules, userID)
+				res, err := msg.ServerUserLeft(userID)
+				if err != nil {
+					ange.Warnln("[Ange] ", err)
+					continue
+				}
+				for client := range ange.clients {
+					client.sendWrapper(res)
+				}
+			}
+			detachMsg, err := msg.ServerDetach(userID)
 			if err != nil {
 				ange.Warnln("[Ange] ", err)
 				continue
 			}
-			for _, user := range ange.attachedClients[userID] {
-				user.mod = nil
-				user.sendWrapper(detachMsg)
+			// Keep clients with sticky attachments to reattach them when the
+			// user reconnects.
+			remaining := ange.attachedClients[userID][:0]
+			for _, client := range ange.attachedClients[userID] {
+				a := client.attachment(userID)
+				if a.mod != mod.RhineModule {
+					remaining = append(remaining, client)
+					continue
+				}
+				a.mod = nil
+				if !mod.isReady() {
+					client.dropStateHooks(userID)
+				}
+				if a.sticky {
+					client.unregisterHooks(userID)
+					remaining = append(remaining, client)
+				} else {
+					client.removeAttachment(userID)
+				}
+				client.sendWrapper(detachMsg)
+			}
+			ange.attachedClients[userID] = remaining
+			if newMod, exists := ange.modules[userID]; exists {
+				ange.reattachClients(newMod)
 			}
-			ange.attachedClients[userID] = nil
+			// Clients following the latest user move to the next latest user.
+			ange.resolveAllPending()
 		}
 	}
 }
 
-var spaceDemliter = []byte(" ")
-
 // Dispatch a client message to an appropriate handler.
 func (ange *Ange) dispatch(m *messageT) {
 	ange.Verbosef("[Ange] received message from %p:%s", m.client, m.payload)
-	s := bytes.SplitN(m.payload, spaceDemliter, 2)
-	if len(s) == 1 {
-		s = append(s, nil)
-	}
-	op := s[0]
-	payload := s[1]
+	op, id, payload := msg.ParseMessage(m.payload)
+	// Replies sent while handling the message are tagged with its request ID.
+	m.client.reqID = id
+	defer func() { m.client.reqID = "" }()
 	// Get handler
-	handler, exists := clientHandlerMap[string(op)]
+	handler, exists := clientHandlerMap[op]
 	if !exists {
-		err := fmt.Errorf("[Ange] Unknown opcode '%s' received", op)
+		err := newError(msg.CodeUnknownOpcode, "Unknown opcode '%s' received", op)
 		ange.Warnln("[Ange] ", err)
 		ange.sendErrorWrapper(m.client, err, m.payload)
 		return
@@ -97,19 +190,243 @@ func (ange *Ange) dispatch(m *messageT) {
 }
 
 func (ange *Ange) sendErrorWrapper(c *Client, err error, message []byte) {
-	b, err := msg.ServerError(message, err.Error())
+	b, err := msg.ServerError(message, errorCode(err), err.Error())
 	if err != nil {
 		ange.Warnln("[Ange] ", err)
 		return
 	}
-	c.sendWrapper(b)
+	c.reply(b)
+}
+
+// userList creates a S_UserList message of the connected users for a client,
+// sorted by the time they connected.
+func (ange *Ange) userList(client *Client) ([]byte, error) {
+	mods := make([]*angeModule, 0, len(ange.modules))
+	for _, mod := range ange.modules {
+		mods = append(mods, mod)
+	}
+	sort.Slice(mods, func(i, j int) bool {
+		return mods[i].connected.Before(mods[j].connected)
+	})
+	if client.features["user_info"] {
+		users := make([]*msg.UserInfo, 0, len(mods))
+		for _, mod := range mods {
+			users = append(users, mod.info())
+		}
+		return msg.ServerUserInfoList(users)
+	}
+	users := make([]string, 0, len(mods))
+	for _, mod := range mods {
+		users = append(users, getModIdentifier(mod.RhineModule))
+	}
+	return msg.ServerUserList(users)
+}
+
+// resumeSession moves the state of the client that owns a session to a newly
+// connected client and replays the hook events the client missed.
+func (ange *Ange) resumeSession(client, old *Client, lastSeq uint64) {
+	if _, connected := ange.clients[old]; connected {
+		// The old connection hasn't timed out yet, take over from it.
+		delete(ange.clients, old)
+		old.close()
+	}
+	delete(ange.sessions, client.sess.token)
+	client.name = old.name
+	client.features = old.features
+	client.attachments = old.attachments
+	client.pending = old.pending
+	client.hookCounter = old.hookCounter
+	client.hooks = old.hooks
+	client.waits = old.waits
+	client.sess = old.sess
+	ange.sessions[client.sess.token] = client
+	users := client.users()
+	for _, user := range users {
+		for i, c := range ange.attachedClients[user] {
+			if c == old {
+				ange.attachedClients[user][i] = client
+			}
+		}
+	}
+	ange.Printf("[Ange] %p resumed session %s", client, client.sess.token)
+	client.sess.resume(client, lastSeq, func(seq uint64, complete bool) {
+		ret, err := msg.ServerResumed(client.sess.token, users, len(client.hooks), seq, complete)
+		if err != nil {
+			ange.Warnln("[Ange] ", err)
+			return
+		}
+		// Called with the session locked, so the reply must not go through it.
+		client.push(msg.TagRequest(ret, client.reqID))
+	})
+}
+
+// reattachClients reattaches clients with sticky attachments waiting for the
+// module's user to reconnect and registers their hooks on the module.
+func (ange *Ange) reattachClients(mod *angeModule) {
+	userID := getModIdentifier(mod.RhineModule)
+	for _, client := range ange.attachedClients[userID] {
+		a := client.attachment(userID)
+		if a.mod != nil {
+			continue
+		}
+		a.mod = mod.RhineModule
+		failed := client.registerHooks(a)
+		ret, err := msg.ServerReattached(userID)
+		if err != nil {
+			ange.Warnln("[Ange] ", err)
+			continue
+		}
+		client.sendWrapper(ret)
+		ange.Printf("[Ange] reattached %p to %s", client, userID)
+		// Hooks that couldn't be registered again are removed.
+		for _, hook := range failed {
+			hook.Unhook()
+			delete(client.hooks, hook.id)
+			ret, err := msg.ServerHookExpired(hook.id, hook.tag, msg.HookExpiredRegisterFailed)
+			if err != nil {
+				ange.Warnln("[Ange] ", err)
+				continue
+			}
+			client.sendWrapper(ret)
+		}
+	}
+	if mod.isReady() {
+		ange.resyncHooks(mod)
+	}
+}
+
+// resyncHooks resyncs the stale hooks of the clients attached to a module's
+// user once its game state is loaded.
+func (ange *Ange) resyncHooks(mod *angeModule) {
+	userID := getModIdentifier(mod.RhineModule)
+	for _, client := range ange.attachedClients[userID] {
+		for _, hook := range client.hooks {
+			if hook.stale && hook.user == userID {
+				hook.resync(mod.RhineModule)
+			}
+		}
+	}
+}
+
+// attachClient attaches a client to a module's user and notifies it with
+// S_Attached.
+func (ange *Ange) attachClient(client *Client, mod *angeModule, sticky bool) *attachment {
+	id := getModIdentifier(mod.RhineModule)
+	a := &attachment{user: id, mod: mod.RhineModule, sticky: sticky}
+	client.attachments = append(client.attachments, a)
+	ange.attachedClients[id] = append(ange.attachedClients[id], client)
+	ange.Printf("[Ange] attached %p to %s", client, id)
+	ret, err := msg.ServerAttached(id)
+	if err != nil {
+		ange.Warnln("[Ange] ", err)
+		return a
+	}
+	client.reply(ret)
+	return a
+}
+
+// applyAttach attaches a client according to an attach request, returning false
+// if the request has to wait for a user to connect.
+func (ange *Ange) applyAttach(client *Client, req *msg.Attach) bool {
+	switch req.User {
+	case msg.AttachLatest:
+		mod := ange.latestModule(nil)
+		if mod == nil {
+			return false
+		}
+		if client.attachment(getModIdentifier(mod.RhineModule)) != nil {
+			return true
+		}
+		ange.detachLatest(client)
+		ange.attachClient(client, mod, false).latest = true
+		return true
+	case msg.AttachAny:
+		mod := ange.latestModule(client)
+		if mod == nil {
+			return false
+		}
+		ange.attachClient(client, mod, req.Sticky)
+		return true
+	}
+	if client.attachment(req.User) != nil {
+		return true
+	}
+	mod, exists := ange.modules[req.User]
+	if !exists {
+		return false
+	}
+	ange.attachClient(client, mod, req.Sticky)
+	return true
+}
+
+// resolveAllPending applies the pending attach requests of every client,
+// including clients with suspended sessions.
+func (ange *Ange) resolveAllPending() {
+	for _, client := range ange.sessions {
+		remaining := client.pending[:0]
+		for _, req := range client.pending {
+			if !ange.applyAttach(client, req) || req.User == msg.AttachLatest {
+				remaining = append(remaining, req)
+			}
+		}
+		client.pending = remaining
+	}
+}
+
+// latestModule returns the most recently connected module, skipping the users
+// the client is attached to if the client isn't nil.
+func (ange *Ange) latestModule(client *Client) *angeModule {
+	var latest *angeModule
+	for id, mod := range ange.modules {
+		if client != nil && client.attachment(id) != nil {
+			continue
+		}
+		if latest == nil || mod.connected.After(latest.connected) {
+			latest = mod
+		}
+	}
+	return latest
+}
+
+// detachLatest detaches a client from the user it was attached to by the
+// '@latest' attach policy, if any.
+func (ange *Ange) detachLatest(client *Client) {
+	for _, a := range client.attachments {
+		if a.latest {
+			ange.detachClient(client, a.user)
+			ange.sendDetached(client, a.user)
+			return
+		}
+	}
+}
+
+func (ange *Ange) sendDetached(client *Client, user string) {
+	ret, err := msg.ServerDetach(user)
+	if err != nil {
+		ange.Warnln("[Ange] ", err)
+		return
+	}
+	client.reply(ret)
 }
 
 // detachClient detaches a client from a user by updating book keeping in the Hub
-// and calling unhook on all their hooks. Calling this on a client that is not
-// attached will result in a panic.
-func (ange *Ange) detachClient(client *Client) {
-	id := getModIdentifier(client.mod)
+// and calling unhook on all the client's hooks on the user. Calling this on a
+// client that is not attached to the user will result in a panic.
+// releaseClient detaches a client that is gone for good from all users, and
+// removes its hooks, C_WaitFor requests and pending attach requests.
+func (ange *Ange) releaseClient(client *Client) {
+	for _, user := range client.users() {
+		ange.detachClient(client, user)
+	}
+	client.unhookAll()
+	for w := range client.waits {
+		delete(client.waits, w)
+		w.hook.Unhook()
+	}
+	client.pending = nil
+}
+
+func (ange *Ange) detachClient(client *Client, id string) {
 	clients := ange.attachedClients[id]
 	i := 0
 	for _, c := range clients {
@@ -119,7 +436,6 @@ func (ange *Ange) detachClient(client *Client) {
 		i++
 	}
 	ange.attachedClients[id] = append(clients[:i], clients[i+1:]...)
-	client.mod = nil
-	client.unhookAll()
+	client.removeAttachment(id)
 	ange.Printf("[Ange] detached %p from %s", client, id)
 }
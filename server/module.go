@@ -2,8 +2,11 @@ package server
 
 import (
 	"strconv"
+	"time"
 
 	"github.com/kyoukaya/rhine/proxy"
+
+	"github.com/kyoukaya/angelina/server/msg"
 )
 
 const modName = "Angelina Module"
@@ -13,6 +16,9 @@ const modName = "Angelina Module"
 type angeModule struct {
 	*proxy.RhineModule
 	*Ange
+	connected time.Time
+	// Closed once the user's game state is loaded.
+	ready chan struct{}
 }
 
 func getModIdentifier(mod *proxy.RhineModule) string {
@@ -23,8 +29,58 @@ func (mod *angeModule) shutdown(bool) {
 	mod.Ange.modDetach <- mod
 }
 
+// waitState waits for the user's game state to be loaded and notifies the hub.
+// StateGet blocks until the initial sync packet has been parsed, the goroutine
+// is leaked if the user disconnects before then.
+func (mod *angeModule) waitState() {
+	_, err := mod.StateGet("status")
+	if err != nil {
+		mod.Warnln("[Ange] ", err)
+	}
+	close(mod.ready)
+	mod.Ange.modReady <- mod
+}
+
+// isReady reports whether the user's game state is loaded, without blocking.
+func (mod *angeModule) isReady() bool {
+	select {
+	case <-mod.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// info returns the description of the module's user sent to clients that
+// enabled the user_info feature. The nickname and level are only read once the
+// game state is loaded as StateGet would block the hub.
+func (mod *angeModule) info() *msg.UserInfo {
+	info := &msg.UserInfo{
+		User:           getModIdentifier(mod.RhineModule),
+		Region:         mod.Region,
+		UID:            mod.UID,
+		ConnectedSince: mod.connected.UnixNano() / int64(time.Millisecond),
+	}
+	if !mod.isReady() {
+		return info
+	}
+	if v, err := mod.StateGet("status.nickName"); err == nil {
+		info.Nickname, _ = v.(string)
+	}
+	if v, err := mod.StateGet("status.level"); err == nil {
+		info.Level, _ = v.(int64)
+	}
+	return info
+}
+
 func (hub *Ange) modInitFunc(mod *proxy.RhineModule) {
-	module := &angeModule{mod, hub}
+	module := &angeModule{
+		RhineModule: mod,
+		Ange:        hub,
+		connected:   time.Now(),
+		ready:       make(chan struct{}),
+	}
 	hub.modAttach <- module
 	mod.OnShutdown(module.shutdown)
+	go module.waitState()
 }
@@ -3,6 +3,7 @@ package msg
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 )
 
 func unmarshal(data []byte, v interface{}) error {
@@ -11,22 +12,185 @@ func unmarshal(data []byte, v interface{}) error {
 	return dec.Decode(v)
 }
 
-func UnmarshalClientAttach(payload []byte) (string, error) {
-	var str string
-	err := unmarshal(payload, &str)
-	return str, err
+// Attach policies that may be used in place of a user in C_Attach.
+const (
+	AttachLatest = "@latest" // Follow the most recently connected user
+	AttachAny    = "@any"    // Attach to any user, waiting for one if necessary
+)
+
+// Attach is the payload of the C_Attach message, which may also be sent as a
+// string containing only the user.
+type Attach struct {
+	User   string `json:"user"`   // User identifier or attach policy
+	Sticky bool   `json:"sticky"` // Keep the attachment when the user disconnects
+	Wait   bool   `json:"wait"`   // Wait for the user to connect if it is not
 }
 
-func UnmarshalClientGet(payload []byte) (string, error) {
-	var str string
-	err := unmarshal(payload, &str)
-	return str, err
+// UnmarshalClientAttach unmarshals the payload of the C_Attach message.
+func UnmarshalClientAttach(payload []byte) (*Attach, error) {
+	var attach Attach
+	if isString(payload) {
+		err := unmarshal(payload, &attach.User)
+		return &attach, err
+	}
+	err := unmarshal(payload, &attach)
+	return &attach, err
+}
+
+// Get is the payload of the C_Get message, which may also be sent as a string
+// containing only the path.
+type Get struct {
+	User   string   `json:"user"` // Optional, defaults to the first attached user
+	Path   string   `json:"path"`
+	Fields []string `json:"fields"` // Optional list of fields to select
+	// Optional query over the elements of an object or array, see the query
+	// package. The result is an array of key and value pairs if any is set.
+	Where string   `json:"where"` // Filter expression
+	Sort  []string `json:"sort"`  // Sort expressions, prefixed with '-' to sort descending
+	Limit int      `json:"limit"` // Maximum number of elements
+	// Optional pagination of object and array values, the cursor of the next
+	// page is sent with each page.
+	PageSize int    `json:"page_size"`
+	Cursor   string `json:"cursor"`
+	// Optionally stream the value in S_GetChunk messages of about chunk_bytes,
+	// which defaults to 16 KiB.
+	Stream     bool `json:"stream"`
+	ChunkBytes int  `json:"chunk_bytes"`
+}
+
+// IsQuery reports whether the C_Get payload is in its query form.
+func (get *Get) IsQuery() bool {
+	return get.Where != "" || len(get.Sort) > 0 || get.Limit != 0
+}
+
+// UnmarshalClientGet unmarshals the payload of the C_Get message.
+func UnmarshalClientGet(payload []byte) (*Get, error) {
+	var get Get
+	if isString(payload) {
+		err := unmarshal(payload, &get.Path)
+		return &get, err
+	}
+	err := unmarshal(payload, &get)
+	return &get, err
+}
+
+// UnmarshalClientGetMany unmarshals the payload of the C_GetMany message, which
+// is either an array of C_Get payloads, or an object mapping aliases to C_Get
+// payloads. aliases is nil if the payload is an array.
+func UnmarshalClientGetMany(payload []byte) (gets []*Get, aliases map[string]*Get, err error) {
+	payload = bytes.TrimSpace(payload)
+	if len(payload) > 0 && payload[0] == '{' {
+		var raw map[string]json.RawMessage
+		if err := unmarshal(payload, &raw); err != nil {
+			return nil, nil, err
+		}
+		aliases = make(map[string]*Get, len(raw))
+		for alias, b := range raw {
+			get, err := UnmarshalClientGet(b)
+			if err != nil {
+				return nil, nil, err
+			}
+			aliases[alias] = get
+		}
+		return nil, aliases, nil
+	}
+	var raw []json.RawMessage
+	if err := unmarshal(payload, &raw); err != nil {
+		return nil, nil, err
+	}
+	gets = make([]*Get, 0, len(raw))
+	for _, b := range raw {
+		get, err := UnmarshalClientGet(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		gets = append(gets, get)
+	}
+	return gets, nil, nil
+}
+
+// Keys is the payload of the C_Keys message, which may also be sent as a string
+// containing only the path.
+type Keys struct {
+	User   string `json:"user"`   // Optional, defaults to the first attached user
+	Path   string `json:"path"`   // Optional, defaults to the whole game state
+	Prefix string `json:"prefix"` // Optional, only list keys starting with the prefix
+}
+
+// UnmarshalClientKeys unmarshals the payload of the C_Keys message.
+func UnmarshalClientKeys(payload []byte) (*Keys, error) {
+	var keys Keys
+	if len(bytes.TrimSpace(payload)) == 0 {
+		return &keys, nil
+	}
+	if isString(payload) {
+		err := unmarshal(payload, &keys.Path)
+		return &keys, err
+	}
+	err := unmarshal(payload, &keys)
+	return &keys, err
+}
+
+// GameData is the payload of the C_GameData message. Entries are either looked
+// up by ID, or searched by name and queried like C_Get.
+type GameData struct {
+	Table  string   `json:"table"`
+	ID     string   `json:"id"`     // Optional ID of an entry
+	Search string   `json:"search"` // Optional case insensitive search term
+	Fields []string `json:"fields"` // Optional list of fields to select
+	Where  string   `json:"where"`  // Optional filter expression
+	Sort   []string `json:"sort"`   // Optional sort expressions
+	Limit  int      `json:"limit"`  // Optional maximum number of entries
+}
+
+// UnmarshalClientGameData unmarshals the payload of the C_GameData message.
+func UnmarshalClientGameData(payload []byte) (*GameData, error) {
+	var data GameData
+	err := unmarshal(payload, &data)
+	return &data, err
+}
+
+// isString reports whether a JSON payload is a string.
+func isString(payload []byte) bool {
+	payload = bytes.TrimSpace(payload)
+	return len(payload) > 0 && payload[0] == '"'
+}
+
+// Hello is the payload of the C_Hello message.
+type Hello struct {
+	Name     string   `json:"name"`
+	Protocol int      `json:"protocol"`
+	Features []string `json:"features"`
+}
+
+// UnmarshalClientHello unmarshals the payload of the C_Hello message.
+func UnmarshalClientHello(payload []byte) (*Hello, error) {
+	var hello Hello
+	err := unmarshal(payload, &hello)
+	return &hello, err
 }
 
 type Hook struct {
-	Kind   string `json:"type"`
-	Target string `json:"target"`
-	Event  bool   `json:"event"`
+	ID        string   `json:"id,omitempty"`   // Optional, generated by the server if empty
+	Tag       string   `json:"tag,omitempty"`  // Optional label echoed in S_Hooked and S_HookEvt
+	User      string   `json:"user,omitempty"` // Optional, defaults to the first attached user
+	Kind      string   `json:"type"`
+	Target    string   `json:"target"`
+	Event     bool     `json:"event"`
+	Filter    string   `json:"filter,omitempty"`    // Optional filter expression, see the query package
+	Fields    []string `json:"fields,omitempty"`    // Optional list of fields to select
+	Delta     bool     `json:"delta,omitempty"`     // Send JSON Patches after the first event
+	Previous  bool     `json:"previous,omitempty"`  // Send the previous value with events
+	Immediate bool     `json:"immediate,omitempty"` // Send the current value when hooked
+	// Optional minimum interval between events or quiet period before events are
+	// sent in milliseconds.
+	ThrottleMS int `json:"throttle_ms,omitempty"`
+	DebounceMS int `json:"debounce_ms,omitempty"`
+	// Optional limits after which the hook is removed by the server, once is
+	// equivalent to a max_events of 1.
+	Once      bool `json:"once,omitempty"`
+	MaxEvents int  `json:"max_events,omitempty"`
+	TTLMS     int  `json:"ttl_ms,omitempty"`
 }
 
 // UnmarshalClientHook unmarshals the payload of the C_Hook message.
@@ -36,9 +200,112 @@ func UnmarshalClientHook(payload []byte) (*Hook, error) {
 	return &hook, err
 }
 
+// UnmarshalClientHookMany unmarshals the payload of the C_HookMany message.
+func UnmarshalClientHookMany(payload []byte) ([]*Hook, error) {
+	var hooks []*Hook
+	if err := unmarshal(payload, &hooks); err != nil {
+		return nil, err
+	}
+	for i, hook := range hooks {
+		if hook == nil {
+			return nil, fmt.Errorf("Hook %d: expected an object", i)
+		}
+	}
+	return hooks, nil
+}
+
+// unmarshalOptionalString unmarshals a string payload, an empty string is
+// returned if the payload is omitted.
+func unmarshalOptionalString(payload []byte) (string, error) {
+	var str string
+	if len(bytes.TrimSpace(payload)) == 0 {
+		return str, nil
+	}
+	err := unmarshal(payload, &str)
+	return str, err
+}
+
+// UnmarshalClientDetach unmarshals the optional payload of the C_Detach message.
+func UnmarshalClientDetach(payload []byte) (string, error) {
+	return unmarshalOptionalString(payload)
+}
+
+// UnhookAll is the optional payload of the C_UnhookAll message, which may also
+// be sent as a string containing only the user.
+type UnhookAll struct {
+	User string `json:"user"` // Only unhook hooks registered on the user
+	Tag  string `json:"tag"`  // Only unhook hooks with the tag
+}
+
+// UnmarshalClientUnhookAll unmarshals the optional payload of the C_UnhookAll
+// message.
+func UnmarshalClientUnhookAll(payload []byte) (*UnhookAll, error) {
+	var unhook UnhookAll
+	if len(bytes.TrimSpace(payload)) == 0 {
+		return &unhook, nil
+	}
+	if isString(payload) {
+		err := unmarshal(payload, &unhook.User)
+		return &unhook, err
+	}
+	err := unmarshal(payload, &unhook)
+	return &unhook, err
+}
+
 // UnmarshalClientUnhook unmarshals the payload of the C_Unhook message.
 func UnmarshalClientUnhook(payload []byte) (string, error) {
 	var str string
 	err := unmarshal(payload, &str)
 	return str, err
 }
+
+// WaitFor is the payload of the C_WaitFor message.
+type WaitFor struct {
+	User      string   `json:"user"` // Optional, defaults to the first attached user
+	Kind      string   `json:"type"`
+	Target    string   `json:"target"`
+	Condition string   `json:"condition"`  // Optional filter expression, see the query package
+	Fields    []string `json:"fields"`     // Optional list of fields to select
+	TimeoutMS int      `json:"timeout_ms"` // Optional, defaults to 30 seconds
+}
+
+// UnmarshalClientWaitFor unmarshals the payload of the C_WaitFor message.
+func UnmarshalClientWaitFor(payload []byte) (*WaitFor, error) {
+	var wait WaitFor
+	err := unmarshal(payload, &wait)
+	return &wait, err
+}
+
+// Resume is the payload of the C_Resume message.
+type Resume struct {
+	Token   string `json:"token"`
+	LastSeq uint64 `json:"last_seq"`
+}
+
+// UnmarshalClientResume unmarshals the payload of the C_Resume message.
+func UnmarshalClientResume(payload []byte) (*Resume, error) {
+	var resume Resume
+	err := unmarshal(payload, &resume)
+	return &resume, err
+}
+
+var (
+	spaceDelimiter     = []byte(" ")
+	requestIDDelimiter = []byte("#")
+)
+
+// ParseMessage splits a raw client message into its opcode, optional request ID
+// and payload. Messages are formatted as '{OP_CODE}[#{REQUEST_ID}] {PAYLOAD}',
+// both the request ID and the payload may be omitted.
+func ParseMessage(message []byte) (op, id string, payload []byte) {
+	s := bytes.SplitN(message, spaceDelimiter, 2)
+	if len(s) == 2 {
+		payload = s[1]
+	}
+	opID := bytes.SplitN(s[0], requestIDDelimiter, 2)
+	op = string(opID[0])
+	if len(opID) == 2 {
+		id = string(opID[1])
+	}
+	return op, id, payload
+}
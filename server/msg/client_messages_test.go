@@ -0,0 +1,27 @@
+package msg
+
+import "testing"
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		message string
+		op, id  string
+		payload string
+	}{
+		{`C_Get {"path":"status"}`, "C_Get", "", `{"path":"status"}`},
+		{`C_Get#42 {"path":"status"}`, "C_Get", "42", `{"path":"status"}`},
+		{`C_Get#a#b {"path":"status"}`, "C_Get", "a#b", `{"path":"status"}`},
+		{`C_Detach`, "C_Detach", "", ``},
+		{`C_Detach#1`, "C_Detach", "1", ``},
+		{`C_Detach#`, "C_Detach", "", ``},
+		{`C_Unhook#1 1 2`, "C_Unhook", "1", `1 2`},
+		{``, "", "", ``},
+	}
+	for _, test := range tests {
+		op, id, payload := ParseMessage([]byte(test.message))
+		if op != test.op || id != test.id || string(payload) != test.payload {
+			t.Errorf("ParseMessage(%q) = %q, %q, %q, expected %q, %q, %q",
+				test.message, op, id, payload, test.op, test.id, test.payload)
+		}
+	}
+}
@@ -6,61 +6,442 @@ With a single space delimiting the op code from the payload. Where the payload
 is a json value, i.e., a json string/array/number/object, but may be omitted
 if no payload is necessary.
 
+Client messages may carry an optional request ID, appended to the op code with
+a '#' delimiter:
+	{OP_CODE}#{REQUEST_ID} {PAYLOAD}
+The request ID may be any string without spaces, the server will echo it back
+on the op code of the reply to the request, including S_Error, e.g., a
+'C_Get#42 "status.ap"' request is answered with 'S_Get#42 {...}'. Messages
+that are not a reply to a request, such as S_HookEvt, are never tagged.
+Request IDs are always supported and don't need to be enabled with C_Hello.
+
 Messages from the server to the client:
-S_UserList - Sent on first connection with Angelina
+S_Hello - Sent in reply to C_Hello
+	{
+		"protocol": "number",  // Protocol version, incremented on breaking changes
+		"version": "string",  // Build version of angelina
+		"opcodes": ["string"],  // Client op codes supported by the server
+		"hook_types": ["string"],  // 'gamestate' and 'packet'
+		"region": "string",  // Region of the loaded gamedata
+		"features": ["string"],  // Optional features supported by the server
+		"enabled": ["string"]  // Features requested by the client that are enabled
+	}
+S_UserList - Sent on first connection with Angelina and in reply to C_ListUsers,
+users are sorted by the time they connected.
 	["string"]  // Array of user identifiers '{REGION}_{UID}'
+Clients that enabled the user_info feature receive an array of user info
+objects instead, the nickname and level are omitted until the user's game
+state is loaded. The S_UserList sent on connection always contains strings as
+the client has yet to send C_Hello.
+	[{
+		"user": "string",  // User identifier '{REGION}_{UID}'
+		"region": "string",
+		"uid": "number",
+		"nickname": "string",
+		"level": "number",
+		"connected_since": "number"  // Unix time in milliseconds
+	}]
+S_Session - Sent after S_Hello in reply to a C_Hello that enabled the resume
+feature.
+	{
+		"token": "string",  // Token required to resume the session with C_Resume
+		"grace_ms": "number"  // Time a session is kept after the client disconnects
+	}
+S_Resumed - Sent in reply to C_Resume, followed by the S_HookEvt messages sent
+after the last sequence number received by the client.
+	{
+		"token": "string",  // Token of the resumed session
+		"user": "string",  // First user the session is attached to, omitted if not attached
+		"users": ["string"],  // Every user the session is attached to
+		"hooks": "number",  // Number of hooks registered
+		"seq": "number",  // Sequence number of the last S_HookEvt sent
+		"complete": "boolean"  // False if some of the missed events were discarded
+	}
 S_NewUser - When a new user logs in through Rhine
 	"string"  // User identifier '{REGION}_{UID}'
+Clients that enabled the user_info feature receive a user info object, see
+S_UserList, once the user's game state is loaded.
+S_UserLeft - When a user disconnects from Rhine
+	"string"  // User identifier '{REGION}_{UID}'
 S_Attached
 	"string"  // User identifier '{REGION}_{UID}'
-S_Detached - When the connected user is disconnected
-	No payload.
+S_AttachPending - Sent in reply to C_Attach if the request waits for a user to
+connect, S_Attached is sent once the client is attached.
+	"string"  // User identifier or attach policy of the request
+S_Detached - In reply to C_Detach or when an attached user is disconnected
+	"string"  // User identifier '{REGION}_{UID}'
+S_Reattached - When the user of a sticky attachment reconnects, the client's
+hooks are registered again. Hooks that could not be registered again are
+removed and S_HookExpired is sent for each of them after S_Reattached.
+	"string"  // User identifier '{REGION}_{UID}'
 S_Hooked - On successful hook request.
 	{
 		"id": "string",  // Required for unhooking
+		"tag": "string",  // Tag of the hook, omitted if not set
+		"user": "string",  // User identifier '{REGION}_{UID}' the hook is registered on
 		"type": "string",  // 'gamestate' or 'packet'
 		"target": "string",
 		"event": "boolean"  // Optional, false if not sent
 	}
+S_HookedMany - On successful C_HookMany request, the hooks are described as in
+S_Hooked in the order they were requested.
+	[{"id": "string", "tag": "string", "user": "string", "type": "string", "target": "string", "event": "boolean"}]
 S_Unhooked - On successful unhook request.
 	"string"
+S_UnhookedAll - On successful C_UnhookAll request.
+	["string"]  // IDs of the hooks that were unhooked
+S_HookExpired - Sent when the server removes a hook after it reached its
+max_events or ttl_ms, after the hook's last S_HookEvt, or when it could not be
+registered again after its user reconnected.
+	{
+		"id": "string",
+		"tag": "string",  // Tag of the hook, omitted if not set
+		"reason": "string"  // 'max_events', 'ttl' or 'register_failed'
+	}
+S_HookList - Sent in reply to C_ListHooks, in the order the hooks were registered.
+	[{
+		"id": "string",
+		// The options the hook was registered with, see C_Hook. Options that
+		// were not set are omitted, the user is always set.
+		"user": "string",
+		"type": "string",
+		"target": "string",
+		"event": "boolean",
+		...
+	}]
 S_HookEvt - Sent when a hook generates an event.
 	{
+		"id": "string",  // ID of the hook that generated the event
+		"tag": "string",  // Tag of the hook, omitted if not set
+		"user": "string",  // User identifier '{REGION}_{UID}' the hook is registered on
 		"type": "string",  // 'gamestate' or 'packet'
 		"target": "string",
+		"ts": "number",  // Unix time in milliseconds when the event was sent
+		"seq": "number",  // Sequence number, incremented for every S_HookEvt sent to the client
 		// data's JSON type may vary depending on the hook target.
 		// Omitted if the hook is an event type
-		"data": "data object"
+		"data": "data object",
+		// JSON Patch sent instead of data by hooks in delta mode
+		"patch": [{"op": "string", "path": "string", "value": "data object"}],
+		// Previous value sent by hooks with the previous option
+		"prev": "data object",
+		"change": "number",  // data - prev, only sent if both are numbers
+		// Sent instead of data by throttled or debounced packet hooks
+		"batch": [{"target": "string", "data": "data object"}]
+	}
+S_WaitResult - Sent exactly once in reply to C_WaitFor.
+	{
+		"status": "string",  // 'matched', 'timeout' or 'detached'
+		"user": "string",
+		"type": "string",
+		"target": "string",  // The op of the packet that matched for packet patterns
+		"data": "data object"  // Only sent if matched
 	}
 S_Get - Sent after the client sends a C_Get request if the get is successful.
 	{
 		"path": "string",
+		"data": "data object",
+		"next": "string"  // Cursor of the next page, if there is one
+	}
+S_GetChunk - Sent instead of S_Get in reply to a streamed C_Get request, with a
+part of the data. Objects and arrays are split between their elements, the data
+of every chunk is an object or array that is merged into or concatenated with
+the previous chunks. Other values are sent in a single chunk.
+	{
+		"path": "string",
+		"seq": int,  // Starts at 1
 		"data": "data object"
 	}
+S_GetEnd - Sent after the last S_GetChunk of a streamed C_Get request.
+	{
+		"path": "string",
+		"chunks": int,  // Number of S_GetChunk messages sent
+		"next": "string"  // Cursor of the next page, if there is one
+	}
+S_GetMany - Sent in reply to C_GetMany, the results are either an array or an
+object mapping aliases to results, matching the request. Every result either
+has the data or the error that occurred while getting the path.
+	[{
+		"path": "string",
+		"data": "data object",
+		"next": "string",  // Cursor of the next page, see C_Get
+		"error": {"code": "string", "error": "string"}  // See S_Error
+	}]
+S_Keys - Sent in reply to C_Keys. Types are one of 'object', 'array', 'string',
+'number', 'boolean' or 'null', the size is the number of elements of objects
+and arrays or the length of strings. Object keys are sorted numerically
+followed by the other keys, array keys are the index of each element.
+	{
+		"path": "string",
+		"type": "string",
+		"size": int,  // Omitted for other types
+		"keys": [{"key": "string" or int, "type": "string", "size": int}]
+	}
+S_GameData - Sent in reply to C_GameData. The data is the entry if an ID was
+requested, and otherwise an array of the matching entries like the query form
+of C_Get, sorted by ID unless a sort was requested.
+	{
+		"table": "string",
+		"id": "string",  // Only sent if requested
+		"search": "string",  // Only sent if requested
+		"data": "data object" or [{"key": "string", "value": "data object"}]
+	}
 S_Error - Sent when an error was generated while handling of a request.
 	{
+		"code": "string",  // Machine readable error code, see below
 		"request": "string",  // The request message that generated the error
-		"error": "string"
+		"error": "string"  // Human readable description of the error
 	}
+The error codes are stable and clients should rely on them instead of the error
+description:
+	internal - an unexpected error occurred on the server
+	unknown_opcode - the op code of the request is not supported
+	bad_payload - the payload of the request could not be unmarshalled
+	not_attached - the request requires the client to be attached to a user
+	already_attached - the client is already attached to the user
+	unknown_user - the user is not connected through Rhine
+	unknown_hook_type - the hook type is not 'gamestate' or 'packet'
+	unknown_hook - no hook is registered with the given hook ID
+	state_path_not_found - the game state path does not exist
+	unknown_session - the session does not exist or has expired
+	duplicate_hook_id - the hook ID chosen by the client is already in use
+	unknown_table - the game data table is not supported
+	gamedata_not_found - the game data table has no entry with the given ID
+	gamedata_loading - the game data tables are still being loaded
+	not_ready - the user's game state is still being loaded
 
 Messages from the client to the server:
+C_Hello - declares the client and the optional features it wishes to use, the
+server replies with S_Hello. Clients may send C_Hello at any time, although it
+is usually the first message sent after connecting. The optional features are:
+	resume - keep the session when the client disconnects, see C_Resume
+	user_info - send user info objects instead of user identifiers
+	{
+		"name": "string",  // Optional, used for logging
+		"protocol": "number",  // Optional, protocol version of the client
+		"features": ["string"]  // Optional
+	}
+C_ListUsers - requests the list of connected users, the server replies with
+S_UserList.
+	No payload
 C_Attach - C_Attach is sent from the websocket client to request for the server to
-attach them to the specified game user. A websocket client can only be attached to
-one user at a time and it is required for hooking and getting information from their game state.
+attach them to the specified game user. Attaching is required for hooking and getting
+information from their game state. A websocket client may be attached to several users
+at once, requests that don't specify a user are handled by the first user attached.
+The payload may either be the user identifier as a string, or an object.
 	"string"
-C_Detach - unhooks all registered hooks and allows the websocket client to attach to another user.
-	No payload
+	{
+		"user": "string",  // User identifier or attach policy
+		"sticky": "boolean",  // Optional, defaults to false
+		"wait": "boolean"  // Optional, wait for the user to connect, defaults to false
+	}
+The user may be one of the following attach policies instead of a user identifier:
+	@latest - attach to the most recently connected user, and move to every user
+	that connects afterwards, or to the next most recent user if it disconnects.
+	The client is sent S_Detached for the previous user before S_Attached.
+	@any - attach to the most recently connected user the client is not attached
+	to, or the first such user to connect.
+Requests that can't be satisfied yet, including requests for a user that is not
+connected with wait set, are answered with S_AttachPending and the client is
+attached as soon as a suitable user connects. Attachments made by '@latest'
+can't be sticky.
+Sticky attachments are kept when the user disconnects, the client receives
+S_Detached but stays attached and keeps its hooks. When the same user connects
+again the hooks are registered on the new session and S_Reattached is sent.
+C_Detach ends a sticky attachment that is waiting for the user to reconnect.
+C_Detach - detaches from a user and unhooks all the hooks registered on the user,
+or from every user if the payload is omitted. S_Detached is sent for every user.
+Pending attach requests are cancelled by detaching from their user or policy,
+detaching from '@latest' also detaches from the user it attached to. Every
+pending request is cancelled if the payload is omitted.
+	"string"  // Optional, user identifier '{REGION}_{UID}' or attach policy
 C_Get - requests a piece of information from the attached user's game state.
+The payload may either be the path as a string, or an object. The path may not
+be empty, C_Keys lists the top-level keys of the game state. Requests fail with not_ready until the
+user's game state is loaded.
+	"string"
+	{
+		"user": "string",  // Optional, defaults to the first attached user
+		"path": "string",
+		"fields": ["string"],  // Optional list of fields to select
+		"where": "string",  // Optional filter expression
+		"sort": ["string"],  // Optional sort expressions
+		"limit": int,  // Optional maximum number of elements
+		"page_size": int,  // Optional maximum number of elements per page
+		"cursor": "string",  // Optional, from the next field of the previous page
+		"stream": bool,  // Optional, reply with S_GetChunk and S_GetEnd
+		"chunk_bytes": int  // Optional size of chunks, defaults to 16384
+	}
+Fields are period separated paths relative to the requested value, where '*'
+matches every key of an object or element of an array. Only the selected fields
+are sent, e.g., requesting 'troop.chars' with the fields '*.level' and
+'*.evolvePhase' returns the level and elite phase of every operator.
+The request is a query if any of where, sort or limit is set, the value at the
+path must then be an object or array. The filter and sort expressions are
+evaluated against an object containing the key and value of each element, e.g.,
+'value.evolvePhase == 2', see C_Hook for their syntax. Sort expressions
+prefixed with '-' sort in descending order, elements without a value sort last.
+Object keys are sorted numerically if no sort is given. The data of S_Get is
+then an array of the selected elements, and fields are selected from the value
+of each element.
+	[{"key": "string" or int, "value": "data object"}]
+Objects, arrays and query results may be requested in pages of at most
+page_size elements. The next field of S_Get holds the cursor to request the
+following page with, it is omitted on the last page. Object keys are paged in
+the order they are sorted in, so pages stay consistent if keys are added or
+removed between requests.
+Values may be streamed in chunks of about chunk_bytes bytes, which are sent in
+their own websocket frames, other messages may be sent in between the chunks.
+Streamed requests must have a request ID, which tags every chunk. A S_Error
+tagged with the request ID is sent instead of the remaining chunks if the value
+fails to be encoded.
+Streaming is not supported by C_GetMany.
+C_GetMany - requests several pieces of information at once, the server replies
+with a single S_GetMany. The payload is either an array of C_Get payloads, or an
+object mapping aliases chosen by the client to C_Get payloads. Errors are
+reported for each path instead of failing the whole request.
+	["string", {...}]
+	{"alias": "string", "alias2": {...}}
+C_Keys - requests the type and size of the value at a path of the game state,
+and of each of its children, to browse the state tree. The server replies with
+S_Keys. The payload may either be the path as a string, or an object. The
+top-level keys of the game state are described if the path is omitted or empty,
+without their sizes, and keys that are null in the user's game state may be
+described as objects. Requests fail with not_ready until the user's game state
+is loaded.
 	"string"
+	{
+		"user": "string",  // Optional, defaults to the first attached user
+		"path": "string",
+		"prefix": "string"  // Optional, only list keys starting with the prefix
+	}
+C_GameData - looks up static game data, the server replies with S_GameData.
+The supported tables are 'items', 'stages', 'operators', 'gacha_tags' and
+'gacha_pools'. Skills and other tables are not downloaded by rhine and are not
+available. Entries are either looked up by their ID, e.g., 'char_002_amiya',
+or searched for by a case insensitive term matched against their ID and name.
+Searches may be combined with a query, see C_Get.
+	{
+		"table": "string",
+		"id": "string",  // Optional ID of an entry
+		"search": "string",  // Optional search term
+		"fields": ["string"],  // Optional list of fields to select
+		"where": "string",  // Optional filter expression
+		"sort": ["string"],  // Optional sort expressions
+		"limit": int  // Optional maximum number of entries
+	}
 C_Hook - requests a hook to be made on either a certain packet being received or if there's
 a change to the gamestate in a certain path. The event value specifies if the websocket
 client only needs to be notified of the change or packet and not sent the data itself.
 	{
+		"id": "string",  // Optional, chosen by the client
+		"tag": "string",  // Optional
+		"user": "string",  // Optional, defaults to the first attached user
 		"type": "string",  // 'gamestate' or 'packet'
 		"target": "string",
-		"event": "boolean"  // Optional, defaults to false
+		"event": "boolean",  // Optional, defaults to false
+		"filter": "string",  // Optional filter expression
+		"fields": ["string"],  // Optional list of fields to select, see C_Get
+		"delta": "boolean",  // Optional, defaults to false
+		"previous": "boolean",  // Optional, defaults to false
+		"immediate": "boolean",  // Optional, defaults to false
+		"throttle_ms": "number",  // Optional, minimum interval between events
+		"debounce_ms": "number",  // Optional, quiet period before events are sent
+		"once": "boolean",  // Optional, same as a max_events of 1
+		"max_events": "number",  // Optional, number of events before the hook expires
+		"ttl_ms": "number"  // Optional, time before the hook expires
 	}
+Hooks with once, max_events or ttl_ms set are removed by the server after
+sending max_events S_HookEvt messages, or ttl_ms milliseconds after being
+hooked, and S_HookExpired is sent. Only one of once or max_events may be set.
+Every packet in the batch of a throttled or debounced packet hook counts as an
+event, the batch is cut short once the limit is reached and the packets beyond
+it are dropped.
+Events held by throttled or debounced hooks are sent before the hook expires.
+Gamestate hooks with immediate set send the current value at the target as
+their first S_HookEvt right after S_Hooked, followed by events for any later
+changes. The server registers hooks asynchronously, so a change made while the
+hook is being registered may either be sent again after the current value, or
+be missed until the next change at the target. Immediate hooks fail with
+not_ready until the user's game state is loaded.
+Hooks may either be throttled or debounced, but not both. Throttled hooks send
+at most one S_HookEvt every throttle_ms milliseconds, while debounced hooks wait
+for debounce_ms milliseconds without any events before sending. Gamestate
+events received in the meantime are coalesced into the latest value, while
+packet hooks send every packet received in the meantime together in the batch
+field. Batches are sent early if they reach 64 packets.
+Gamestate hooks in delta mode send the full value in the data of their first
+event, subsequent events carry a JSON Patch (RFC 6902) in the patch field that
+transforms the last value sent by the hook into the new value. Events that do
+not change the value are not sent.
+Gamestate hooks with previous set send the last value sent by the hook in the
+prev field of every event but the first, along with the difference between the
+new and previous values in the change field if both are numbers.
+When the user of a sticky attachment reconnects, delta and previous hooks send
+an event for the current value once the new game state is loaded, relative to
+the last value sent before the user disconnected. Delta hooks only send it if
+the value changed.
+The filter is an expression evaluated against an object containing the target
+and data of each event, only events that match are sent to the client, e.g.,
+'data.count > 100' or 'exists(data.chars["char_002_amiya"])'. The data of
+event hooks on gamestate paths is always null. See the query package for the
+syntax of filter expressions.
+Packet hook targets may be glob patterns, matched against the op of every
+packet received. Patterns ending with '*' match every op with the same prefix,
+e.g., 'S/gacha/*' matches every gacha packet and 'S/*' every packet sent by
+the server, other patterns follow the syntax of path.Match. The target of the
+S_HookEvt generated by a pattern hook is the op of the packet.
+Hooks are identified by an ID generated by the server unless the client
+chooses one, chosen IDs must be unique among the client's hooks and must not be
+numeric as numeric IDs are reserved for the server. The optional tag is a
+label that doesn't have to be unique. Both are echoed in S_Hooked and every
+S_HookEvt of the hook, allowing clients to route events without keeping track
+of the IDs generated by the server.
+C_HookMany - registers a list of hooks, replied to with a single S_HookedMany.
+None of the hooks are registered if any of them fails, the error describes the
+index of the hook that failed.
+	[{...}]  // Array of C_Hook payloads
 C_Unhook - stop listening on an event.
 	"string"  // Hook ID
+C_UnhookAll - unhooks every hook, or only the hooks registered on a user and/or
+with a tag, the server replies with S_UnhookedAll. The payload may be omitted,
+be the user identifier as a string, or an object.
+	"string"
+	{
+		"user": "string",  // Optional, user identifier '{REGION}_{UID}'
+		"tag": "string"  // Optional
+	}
+C_ListHooks - requests the list of hooks registered by the client, the server
+replies with S_HookList.
+	No payload
+C_WaitFor - waits for a packet or a change to the gamestate that matches an
+optional condition, the server replies with a single S_WaitResult once an event
+matches, the timeout runs out, or the client is detached from the user or the
+user disconnects.
+	{
+		"user": "string",  // Optional, defaults to the first attached user
+		"type": "string",  // 'gamestate' or 'packet'
+		"target": "string",  // Packet targets may be patterns, see C_Hook
+		"condition": "string",  // Optional filter expression, see C_Hook
+		"fields": ["string"],  // Optional list of fields to select, see C_Get
+		"timeout_ms": "number"  // Optional, defaults to 30000
+	}
+The condition of gamestate waits is first evaluated against the current value
+at the target, the result is sent immediately if it matches. Gamestate waits
+without a condition wait for the next change. Gamestate waits with a condition
+fail with not_ready until the user's game state is loaded.
+C_Resume - resumes the session of a previous connection, restoring its attached
+users and hooks. Sessions of attached clients that enabled the resume feature
+are kept for grace_ms after they disconnect, during which hook events are still
+buffered. The last 100 events sent are kept and those with a sequence number
+greater than last_seq are sent after S_Resumed. Other messages sent while the
+client was disconnected, e.g., S_HookExpired, S_WaitResult or S_Detached, are
+sent after the events, only the last 20 are kept. The client must not be
+attached to resume a session, and the features of the session replace those
+enabled by the client.
+	{
+		"token": "string",  // Token received in S_Session
+		"last_seq": "number"  // Sequence number of the last S_HookEvt received
+	}
 */
 package msg
@@ -1,8 +1,9 @@
 package msg
 
 import (
+	"bytes"
 	"encoding/json"
-	"strconv"
+	"time"
 )
 
 func newBytes(old []byte) []byte {
@@ -11,6 +12,26 @@ func newBytes(old []byte) []byte {
 	return ret
 }
 
+// TagRequest appends the request ID to the opcode of a server message so that
+// the client is able to match the reply to the request that generated it, i.e.,
+// 'S_Get {...}' becomes 'S_Get#{REQUEST_ID} {...}'. The message is returned as
+// is if the ID is empty.
+func TagRequest(message []byte, id string) []byte {
+	if id == "" {
+		return message
+	}
+	i := bytes.IndexByte(message, ' ')
+	if i == -1 {
+		i = len(message)
+	}
+	ret := make([]byte, 0, len(message)+len(id)+1)
+	ret = append(ret, message[:i]...)
+	ret = append(ret, '#')
+	ret = append(ret, id...)
+	ret = append(ret, message[i:]...)
+	return ret
+}
+
 var userList = []byte("S_UserList ")
 
 // ServerUserList creates a message informing the client of the already attached
@@ -25,6 +46,116 @@ func ServerUserList(users []string) ([]byte, error) {
 	return ret, nil
 }
 
+// UserInfo describes a user connected through Rhine, sent in place of the user
+// identifier to clients that enabled the user_info feature.
+type UserInfo struct {
+	User   string `json:"user"` // User identifier '{REGION}_{UID}'
+	Region string `json:"region"`
+	UID    int    `json:"uid"`
+	// Omitted until the user's game state is loaded.
+	Nickname       string `json:"nickname,omitempty"`
+	Level          int64  `json:"level,omitempty"`
+	ConnectedSince int64  `json:"connected_since"` // Unix time in milliseconds
+}
+
+// ServerUserInfoList creates a S_UserList message with the info of every user
+// for clients that enabled the user_info feature.
+func ServerUserInfoList(users []*UserInfo) ([]byte, error) {
+	ret := newBytes(userList)
+	b, err := json.Marshal(users)
+	if err != nil {
+		return nil, err
+	}
+	ret = append(ret, b...)
+	return ret, nil
+}
+
+// ProtocolVersion is incremented whenever a change to the protocol may break
+// existing clients.
+const ProtocolVersion = 1
+
+var serverHello = []byte("S_Hello ")
+
+// HelloInfo describes the server's capabilities in reply to a C_Hello message.
+type HelloInfo struct {
+	Protocol  int      `json:"protocol"`
+	Version   string   `json:"version"`
+	Opcodes   []string `json:"opcodes"`
+	HookTypes []string `json:"hook_types"`
+	Region    string   `json:"region"`
+	Features  []string `json:"features"`
+	Enabled   []string `json:"enabled"`
+}
+
+// ServerHello creates a message informing the client of the server's protocol
+// version and capabilities.
+func ServerHello(info *HelloInfo) ([]byte, error) {
+	ret := newBytes(serverHello)
+	b, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	ret = append(ret, b...)
+	return ret, nil
+}
+
+var serverSession = []byte("S_Session ")
+
+type serverSessionT struct {
+	Token string `json:"token"`
+	Grace int64  `json:"grace_ms"`
+}
+
+// ServerSession creates a message informing the client of the token required
+// to resume its session after reconnecting, and how long the session is kept.
+func ServerSession(token string, grace time.Duration) ([]byte, error) {
+	ret := newBytes(serverSession)
+	b, err := json.Marshal(serverSessionT{
+		Token: token,
+		Grace: int64(grace / time.Millisecond),
+	})
+	if err != nil {
+		return nil, err
+	}
+	ret = append(ret, b...)
+	return ret, nil
+}
+
+var serverResumed = []byte("S_Resumed ")
+
+type serverResumedT struct {
+	Token    string   `json:"token"`
+	User     string   `json:"user,omitempty"`
+	Users    []string `json:"users,omitempty"`
+	Hooks    int      `json:"hooks"`
+	Seq      uint64   `json:"seq"`
+	Complete bool     `json:"complete"`
+}
+
+// ServerResumed creates a message notifying the client that it has resumed its
+// session, the missed hook events are sent after this message. user is the
+// first of the users the session is attached to.
+func ServerResumed(token string, users []string, hooks int, seq uint64, complete bool) ([]byte, error) {
+	ret := newBytes(serverResumed)
+	var user string
+	if len(users) > 0 {
+		user = users[0]
+	}
+	b, err := json.Marshal(serverResumedT{
+		Token:    token,
+		User:     user,
+		Users:    users,
+		Hooks:    hooks,
+		Seq:      seq,
+		Complete: complete,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ret = append(ret, b...)
+	return ret, nil
+}
+
 var serverNewUser = []byte("S_NewUser ")
 
 // ServerNewUser creates a message notifying the client that a new user has
@@ -39,6 +170,32 @@ func ServerNewUser(user string) ([]byte, error) {
 	return ret, nil
 }
 
+// ServerNewUserInfo creates a S_NewUser message with the info of the user for
+// clients that enabled the user_info feature.
+func ServerNewUserInfo(user *UserInfo) ([]byte, error) {
+	ret := newBytes(serverNewUser)
+	b, err := json.Marshal(user)
+	if err != nil {
+		return nil, err
+	}
+	ret = append(ret, b...)
+	return ret, nil
+}
+
+var serverUserLeft = []byte("S_UserLeft ")
+
+// ServerUserLeft creates a message notifying the client that a user has
+// disconnected from Rhine and is no longer available to attach to.
+func ServerUserLeft(user string) ([]byte, error) {
+	ret := newBytes(serverUserLeft)
+	b, err := json.Marshal(user)
+	if err != nil {
+		return nil, err
+	}
+	ret = append(ret, b...)
+	return ret, nil
+}
+
 var serverAttached = []byte("S_Attached ")
 
 // ServerAttached creates a message notifying the client that they've successfully
@@ -53,18 +210,55 @@ func ServerAttached(user string) ([]byte, error) {
 	return ret, nil
 }
 
-var serverDetach = []byte("S_Detached")
+var serverAttachPending = []byte("S_AttachPending ")
 
-// ServerDetach creates a message notifying the client that the user they were
-// attached to has disconnected.
-func ServerDetach() ([]byte, error) {
-	return serverDetach, nil
+// ServerAttachPending creates a message notifying the client that its attach
+// request is waiting for a user to connect, S_Attached is sent once attached.
+func ServerAttachPending(user string) ([]byte, error) {
+	ret := newBytes(serverAttachPending)
+	b, err := json.Marshal(user)
+	if err != nil {
+		return nil, err
+	}
+	ret = append(ret, b...)
+	return ret, nil
+}
+
+var serverReattached = []byte("S_Reattached ")
+
+// ServerReattached creates a message notifying a client with a sticky attachment
+// that the user has reconnected and the client's hooks have been restored.
+func ServerReattached(user string) ([]byte, error) {
+	ret := newBytes(serverReattached)
+	b, err := json.Marshal(user)
+	if err != nil {
+		return nil, err
+	}
+	ret = append(ret, b...)
+	return ret, nil
+}
+
+var serverDetach = []byte("S_Detached ")
+
+// ServerDetach creates a message notifying the client that it has been detached
+// from a user, either on request or because the user has disconnected.
+func ServerDetach(user string) ([]byte, error) {
+	ret := newBytes(serverDetach)
+	b, err := json.Marshal(user)
+	if err != nil {
+		return nil, err
+	}
+	ret = append(ret, b...)
+	return ret, nil
 }
 
 var serverHooked = []byte("S_Hooked ")
 
-type serverHookedT struct {
+// Hooked describes a hook registered by the client.
+type Hooked struct {
 	ID     string `json:"id"`
+	Tag    string `json:"tag,omitempty"`
+	User   string `json:"user"`
 	Kind   string `json:"type"`
 	Target string `json:"target"`
 	Event  bool   `json:"event,omitempty"`
@@ -72,14 +266,38 @@ type serverHookedT struct {
 
 // ServerHooked creates a message to notify the client that they have successfully
 // registered a hook for an event.
-func ServerHooked(id uint64, kind, target string, event bool) ([]byte, error) {
+func ServerHooked(hooked *Hooked) ([]byte, error) {
 	ret := newBytes(serverHooked)
-	res, err := json.Marshal(serverHookedT{
-		ID:     strconv.FormatUint(id, 10),
-		Kind:   kind,
-		Target: target,
-		Event:  event,
-	})
+	res, err := json.Marshal(hooked)
+	if err != nil {
+		return nil, err
+	}
+	ret = append(ret, res...)
+	return ret, nil
+}
+
+var serverHookedMany = []byte("S_HookedMany ")
+
+// ServerHookedMany creates a message to notify the client that they have
+// successfully registered every hook of a C_HookMany request, in the order they
+// were requested.
+func ServerHookedMany(hooked []*Hooked) ([]byte, error) {
+	ret := newBytes(serverHookedMany)
+	res, err := json.Marshal(hooked)
+	if err != nil {
+		return nil, err
+	}
+	ret = append(ret, res...)
+	return ret, nil
+}
+
+var serverHookList = []byte("S_HookList ")
+
+// ServerHookList creates a message listing the hooks registered by the client
+// along with the options they were registered with.
+func ServerHookList(hooks []*Hook) ([]byte, error) {
+	ret := newBytes(serverHookList)
+	res, err := json.Marshal(hooks)
 	if err != nil {
 		return nil, err
 	}
@@ -91,9 +309,54 @@ var serverUnhooked = []byte("S_Unhooked ")
 
 // ServerUnhooked creates a message to notify that they have successfully unhooked
 // for an event.
-func ServerUnhooked(id uint64) ([]byte, error) {
+func ServerUnhooked(id string) ([]byte, error) {
 	ret := newBytes(serverUnhooked)
-	res, err := json.Marshal(strconv.FormatUint(id, 10))
+	res, err := json.Marshal(id)
+	if err != nil {
+		return nil, err
+	}
+	ret = append(ret, res...)
+	return ret, nil
+}
+
+var serverUnhookedAll = []byte("S_UnhookedAll ")
+
+// ServerUnhookedAll creates a message to notify the client of the hooks that
+// were unhooked by C_UnhookAll.
+func ServerUnhookedAll(ids []string) ([]byte, error) {
+	ret := newBytes(serverUnhookedAll)
+	res, err := json.Marshal(ids)
+	if err != nil {
+		return nil, err
+	}
+	ret = append(ret, res...)
+	return ret, nil
+}
+
+var serverHookExpired = []byte("S_HookExpired ")
+
+// Reasons for a hook to expire sent with S_HookExpired.
+const (
+	HookExpiredMaxEvents      = "max_events"
+	HookExpiredTTL            = "ttl"
+	HookExpiredRegisterFailed = "register_failed" // Not registered again on reattach
+)
+
+type serverHookExpiredT struct {
+	ID     string `json:"id"`
+	Tag    string `json:"tag,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// ServerHookExpired creates a message to notify the client that a hook has been
+// removed by the server after reaching its event limit or TTL.
+func ServerHookExpired(id, tag, reason string) ([]byte, error) {
+	ret := newBytes(serverHookExpired)
+	res, err := json.Marshal(serverHookExpiredT{
+		ID:     id,
+		Tag:    tag,
+		Reason: reason,
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -103,20 +366,91 @@ func ServerUnhooked(id uint64) ([]byte, error) {
 
 var serverHookEvt = []byte("S_HookEvt ")
 
-type serverHookEvtT struct {
+// HookEvt is the envelope of a S_HookEvt message.
+type HookEvt struct {
+	ID     string      `json:"id"`
+	Tag    string      `json:"tag,omitempty"`
+	User   string      `json:"user"`
 	Kind   string      `json:"type"`
+	Target string      `json:"target"`
+	Time   int64       `json:"ts"`  // Unix time in milliseconds
+	Seq    uint64      `json:"seq"` // Monotonic per client sequence number
+	Data   interface{} `json:"data,omitempty"`
+	Patch  interface{} `json:"patch,omitempty"`  // JSON Patch sent instead of data in delta mode
+	Prev   interface{} `json:"prev,omitempty"`   // Previous value sent by the hook
+	Change *float64    `json:"change,omitempty"` // Difference between data and prev if both are numbers
+	// Packets sent together by throttled or debounced packet hooks
+	Batch []HookBatchItem `json:"batch,omitempty"`
+}
+
+// HookBatchItem is a single packet in a batched S_HookEvt.
+type HookBatchItem struct {
 	Target string      `json:"target"`
 	Data   interface{} `json:"data,omitempty"`
 }
 
 // ServerHookEvt notifies the client when a hook generates an event.
-func ServerHookEvt(kind, target string, data interface{}) ([]byte, error) {
+func ServerHookEvt(evt *HookEvt) ([]byte, error) {
 	ret := newBytes(serverHookEvt)
-	res, err := json.Marshal(serverHookEvtT{
-		Kind:   kind,
-		Target: target,
-		Data:   data,
-	})
+	res, err := json.Marshal(evt)
+	if err != nil {
+		return nil, err
+	}
+	ret = append(ret, res...)
+	return ret, nil
+}
+
+var serverGetMany = []byte("S_GetMany ")
+
+// ErrorInfo describes an error that occurred while handling part of a request.
+type ErrorInfo struct {
+	Code  ErrorCode `json:"code"`
+	Error string    `json:"error"`
+}
+
+// GetResult is the result of one of the paths of a C_GetMany request, only one
+// of Data or Error is set.
+type GetResult struct {
+	Path  string      `json:"path"`
+	Data  interface{} `json:"data,omitempty"`
+	Next  string      `json:"next,omitempty"` // Cursor of the next page
+	Error *ErrorInfo  `json:"error,omitempty"`
+}
+
+// ServerGetMany creates a message with the results of a C_GetMany request,
+// either an array or a map of aliases to results, matching the request.
+func ServerGetMany(results interface{}) ([]byte, error) {
+	ret := newBytes(serverGetMany)
+	res, err := json.Marshal(results)
+	if err != nil {
+		return nil, err
+	}
+	ret = append(ret, res...)
+	return ret, nil
+}
+
+var serverWaitResult = []byte("S_WaitResult ")
+
+// Status of a C_WaitFor request sent with S_WaitResult.
+const (
+	WaitMatched  = "matched"  // An event matched the condition
+	WaitTimeout  = "timeout"  // No event matched before the timeout
+	WaitDetached = "detached" // The client was detached or the user disconnected
+)
+
+// WaitResult is the result of a C_WaitFor request.
+type WaitResult struct {
+	Status string      `json:"status"`
+	User   string      `json:"user"`
+	Kind   string      `json:"type"`
+	Target string      `json:"target"`
+	Data   interface{} `json:"data,omitempty"`
+}
+
+// ServerWaitResult creates a message with the result of a C_WaitFor request.
+func ServerWaitResult(result *WaitResult) ([]byte, error) {
+	ret := newBytes(serverWaitResult)
+	res, err := json.Marshal(result)
 	if err != nil {
 		return nil, err
 	}
@@ -129,14 +463,17 @@ var serverGet = []byte("S_Get ")
 type serverGetT struct {
 	Path string      `json:"path"`
 	Data interface{} `json:"data,omitempty"`
+	Next string      `json:"next,omitempty"`
 }
 
-// ServerGet creates a message relaying the results of their C_Get request.
-func ServerGet(path string, data interface{}) ([]byte, error) {
+// ServerGet creates a message relaying the results of their C_Get request, next
+// is the cursor of the next page if the request was paginated.
+func ServerGet(path string, data interface{}, next string) ([]byte, error) {
 	ret := newBytes(serverGet)
 	res, err := json.Marshal(serverGetT{
 		Path: path,
 		Data: data,
+		Next: next,
 	})
 	if err != nil {
 		return nil, err
@@ -145,18 +482,143 @@ func ServerGet(path string, data interface{}) ([]byte, error) {
 	return ret, nil
 }
 
+var serverGetChunk = []byte("S_GetChunk ")
+
+type serverGetChunkT struct {
+	Path string          `json:"path"`
+	Seq  int             `json:"seq"`
+	Data json.RawMessage `json:"data"`
+}
+
+// ServerGetChunk creates a message with a chunk of the value streamed in reply
+// to a C_Get request, data is already encoded.
+func ServerGetChunk(path string, seq int, data []byte) ([]byte, error) {
+	ret := newBytes(serverGetChunk)
+	res, err := json.Marshal(serverGetChunkT{
+		Path: path,
+		Seq:  seq,
+		Data: data,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ret = append(ret, res...)
+	return ret, nil
+}
+
+var serverGetEnd = []byte("S_GetEnd ")
+
+type serverGetEndT struct {
+	Path   string `json:"path"`
+	Chunks int    `json:"chunks"`
+	Next   string `json:"next,omitempty"`
+}
+
+// ServerGetEnd creates a message ending a streamed C_Get reply, chunks is the
+// number of S_GetChunk messages sent.
+func ServerGetEnd(path string, chunks int, next string) ([]byte, error) {
+	ret := newBytes(serverGetEnd)
+	res, err := json.Marshal(serverGetEndT{
+		Path:   path,
+		Chunks: chunks,
+		Next:   next,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ret = append(ret, res...)
+	return ret, nil
+}
+
+var serverKeys = []byte("S_Keys ")
+
+// KeyInfo describes a value in the game state, size is the number of elements of
+// an object or array, or the length of a string.
+type KeyInfo struct {
+	Key  interface{} `json:"key,omitempty"` // String for objects, int for arrays
+	Type string      `json:"type"`
+	Size *int        `json:"size,omitempty"`
+}
+
+// KeyList is the reply to a C_Keys request, describing the value at the path
+// and its children.
+type KeyList struct {
+	Path string `json:"path"`
+	KeyInfo
+	Keys []*KeyInfo `json:"keys"`
+}
+
+// ServerKeys creates a message listing the keys under a path of the game state.
+func ServerKeys(keys *KeyList) ([]byte, error) {
+	ret := newBytes(serverKeys)
+	res, err := json.Marshal(keys)
+	if err != nil {
+		return nil, err
+	}
+	ret = append(ret, res...)
+	return ret, nil
+}
+
+var serverGameData = []byte("S_GameData ")
+
+// GameDataResult is the reply to a C_GameData request. The data is the entry
+// with the ID if one was requested, and a list of the matching entries
+// otherwise.
+type GameDataResult struct {
+	Table  string      `json:"table"`
+	ID     string      `json:"id,omitempty"`
+	Search string      `json:"search,omitempty"`
+	Data   interface{} `json:"data"`
+}
+
+// ServerGameData creates a message with the result of a C_GameData request.
+func ServerGameData(result *GameDataResult) ([]byte, error) {
+	ret := newBytes(serverGameData)
+	res, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	ret = append(ret, res...)
+	return ret, nil
+}
+
 var serverError = []byte("S_Error ")
 
+// ErrorCode is a stable, machine readable identifier for the cause of an error
+// sent with S_Error.
+type ErrorCode string
+
+// Error codes sent with S_Error.
+const (
+	CodeInternal          ErrorCode = "internal"
+	CodeUnknownOpcode     ErrorCode = "unknown_opcode"
+	CodeBadPayload        ErrorCode = "bad_payload"
+	CodeNotAttached       ErrorCode = "not_attached"
+	CodeAlreadyAttached   ErrorCode = "already_attached"
+	CodeUnknownUser       ErrorCode = "unknown_user"
+	CodeUnknownHookType   ErrorCode = "unknown_hook_type"
+	CodeUnknownHook       ErrorCode = "unknown_hook"
+	CodeStatePathNotFound ErrorCode = "state_path_not_found"
+	CodeUnknownSession    ErrorCode = "unknown_session"
+	CodeDuplicateHookID   ErrorCode = "duplicate_hook_id"
+	CodeUnknownTable      ErrorCode = "unknown_table"
+	CodeGameDataNotFound  ErrorCode = "gamedata_not_found"
+	CodeGameDataLoading   ErrorCode = "gamedata_loading"
+	CodeNotReady          ErrorCode = "not_ready"
+)
+
 type serverErrorT struct {
-	Error   string `json:"error"`
-	Request string `json:"request"`
+	Code    ErrorCode `json:"code"`
+	Error   string    `json:"error"`
+	Request string    `json:"request"`
 }
 
 // ServerError creates a message to notify the client that an error has occurred
 // during the handling of a request.
-func ServerError(request []byte, err string) ([]byte, error) {
+func ServerError(request []byte, code ErrorCode, err string) ([]byte, error) {
 	ret := newBytes(serverError)
 	res, mErr := json.Marshal(serverErrorT{
+		Code:    code,
 		Error:   err,
 		Request: string(request),
 	})
@@ -0,0 +1,29 @@
+package msg
+
+import "testing"
+
+func TestTagRequest(t *testing.T) {
+	tests := []struct {
+		message string
+		id      string
+		want    string
+	}{
+		{`S_Get {"path":"status"}`, "42", `S_Get#42 {"path":"status"}`},
+		{`S_Get {"path":"status"}`, "", `S_Get {"path":"status"}`},
+		{`S_Detached`, "1", `S_Detached#1`},
+		{`S_Error {"error":"a b"}`, "x", `S_Error#x {"error":"a b"}`},
+	}
+	for _, test := range tests {
+		if got := string(TagRequest([]byte(test.message), test.id)); got != test.want {
+			t.Errorf("TagRequest(%q, %q) = %q, expected %q", test.message, test.id, got, test.want)
+		}
+	}
+}
+
+func TestTagRequestCopies(t *testing.T) {
+	message := []byte(`S_Get {}`)
+	TagRequest(message, "1")
+	if string(message) != `S_Get {}` {
+		t.Errorf("TagRequest modified the message: %q", message)
+	}
+}
@@ -0,0 +1,371 @@
+/*
+Package query implements filtering and transformation of JSON values sent to
+angelina clients, such as packets and game state values.
+
+Filter expressions are a small expression language evaluated against a JSON
+value, for example:
+
+	data.count > 100 && target == "S/gacha/refreshTags"
+	exists(data.chars["char_002_amiya"])
+
+Identifiers are looked up as keys of the root value, object keys and array
+indices are accessed with '.key' or '["key"]' and '.0' or '[0]', e.g.,
+'data.chars.1.level'. Supported operators
+are ==, !=, <, <=, >, >=, &&, || and !, along with parentheses. Literals may be
+numbers, single or double quoted strings, true, false and null. The functions
+exists(path), len(value) and contains(value, elem) are provided. Paths that
+do not exist evaluate to null.
+*/
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Expr is a parsed filter expression.
+type Expr struct {
+	src  string
+	root node
+}
+
+// Parse parses a filter expression.
+func Parse(s string) (*Expr, error) {
+	toks, err := lex(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("Unexpected '%s' at %d", tok.text, tok.pos)
+	}
+	return &Expr{s, root}, nil
+}
+
+// Eval evaluates the expression against a normalized JSON value.
+func (e *Expr) Eval(v interface{}) interface{} {
+	return e.root.eval(v)
+}
+
+// Match reports whether the expression evaluates to a truthy value, i.e., not
+// false, null, 0 or an empty string.
+func (e *Expr) Match(v interface{}) bool {
+	return truthy(e.root.eval(v))
+}
+
+func (e *Expr) String() string {
+	return e.src
+}
+
+type node interface {
+	eval(root interface{}) interface{}
+}
+
+type literalNode struct {
+	val interface{}
+}
+
+func (n *literalNode) eval(interface{}) interface{} {
+	return n.val
+}
+
+type pathNode struct {
+	keys []string
+}
+
+func (n *pathNode) lookup(root interface{}) (interface{}, bool) {
+	v := root
+	for _, key := range n.keys {
+		var ok bool
+		v, ok = child(v, key)
+		if !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func (n *pathNode) eval(root interface{}) interface{} {
+	v, _ := n.lookup(root)
+	return v
+}
+
+type notNode struct {
+	operand node
+}
+
+func (n *notNode) eval(root interface{}) interface{} {
+	return !truthy(n.operand.eval(root))
+}
+
+type binaryNode struct {
+	op   string
+	l, r node
+}
+
+func (n *binaryNode) eval(root interface{}) interface{} {
+	switch n.op {
+	case "&&":
+		return truthy(n.l.eval(root)) && truthy(n.r.eval(root))
+	case "||":
+		return truthy(n.l.eval(root)) || truthy(n.r.eval(root))
+	}
+	l, r := n.l.eval(root), n.r.eval(root)
+	switch n.op {
+	case "==":
+		return equal(l, r)
+	case "!=":
+		return !equal(l, r)
+	}
+	c, ok := compare(l, r)
+	if !ok {
+		return false
+	}
+	switch n.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+type callNode struct {
+	fn   string
+	args []node
+}
+
+func (n *callNode) eval(root interface{}) interface{} {
+	switch n.fn {
+	case "exists":
+		_, ok := n.args[0].(*pathNode).lookup(root)
+		return ok
+	case "len":
+		if l := Length(n.args[0].eval(root)); l >= 0 {
+			return float64(l)
+		}
+		return nil
+	case "contains":
+		elem := n.args[1].eval(root)
+		switch t := n.args[0].eval(root).(type) {
+		case string:
+			s, ok := elem.(string)
+			return ok && strings.Contains(t, s)
+		case []interface{}:
+			for _, v := range t {
+				if equal(v, elem) {
+					return true
+				}
+			}
+		case map[string]interface{}:
+			s, ok := elem.(string)
+			if ok {
+				_, exists := t[s]
+				return exists
+			}
+		}
+		return false
+	}
+	return nil
+}
+
+// Number of arguments accepted by each function.
+var functions = map[string]int{
+	"exists":   1,
+	"len":      1,
+	"contains": 2,
+}
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.toks[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// accept consumes the next token if it is the operator op.
+func (p *parser) accept(op string) bool {
+	if tok := p.peek(); tok.kind == tokOp && tok.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(op string) error {
+	if !p.accept(op) {
+		tok := p.peek()
+		return fmt.Errorf("Expected '%s' at %d", op, tok.pos)
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = &binaryNode{"||", l, r}
+	}
+	return l, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	l, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		r, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l = &binaryNode{"&&", l, r}
+	}
+	return l, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if p.accept("!") {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand}, nil
+	}
+	return p.parseComparison()
+}
+
+var comparisonOps = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+func (p *parser) parseComparison() (node, error) {
+	l, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range comparisonOps {
+		if p.accept(op) {
+			r, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			return &binaryNode{op, l, r}, nil
+		}
+	}
+	return l, nil
+}
+
+func (p *parser) parseOperand() (node, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokNumber:
+		return &literalNode{tok.num}, nil
+	case tokString:
+		return &literalNode{tok.text}, nil
+	case tokOp:
+		if tok.text == "(" {
+			n, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return n, p.expect(")")
+		}
+	case tokIdent:
+		switch tok.text {
+		case "true":
+			return &literalNode{true}, nil
+		case "false":
+			return &literalNode{false}, nil
+		case "null":
+			return &literalNode{nil}, nil
+		}
+		if p.accept("(") {
+			return p.parseCall(tok)
+		}
+		return p.parsePath(tok)
+	}
+	if tok.kind == tokEOF {
+		return nil, fmt.Errorf("Unexpected end of expression")
+	}
+	return nil, fmt.Errorf("Unexpected '%s' at %d", tok.text, tok.pos)
+}
+
+func (p *parser) parseCall(fn token) (node, error) {
+	nArgs, exists := functions[fn.text]
+	if !exists {
+		return nil, fmt.Errorf("Unknown function '%s' at %d", fn.text, fn.pos)
+	}
+	var args []node
+	for !p.accept(")") {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	if len(args) != nArgs {
+		return nil, fmt.Errorf("%s takes %d argument(s), got %d", fn.text, nArgs, len(args))
+	}
+	if _, ok := args[0].(*pathNode); fn.text == "exists" && !ok {
+		return nil, fmt.Errorf("exists requires a path argument at %d", fn.pos)
+	}
+	return &callNode{fn.text, args}, nil
+}
+
+func (p *parser) parsePath(first token) (node, error) {
+	keys := []string{first.text}
+	for {
+		switch {
+		case p.accept("."):
+			tok := p.next()
+			if tok.kind != tokIdent && tok.kind != tokNumber {
+				return nil, fmt.Errorf("Expected a key at %d", tok.pos)
+			}
+			keys = append(keys, tok.text)
+		case p.accept("["):
+			tok := p.next()
+			switch tok.kind {
+			case tokString:
+				keys = append(keys, tok.text)
+			case tokNumber:
+				keys = append(keys, strconv.FormatFloat(tok.num, 'f', -1, 64))
+			default:
+				return nil, fmt.Errorf("Expected a key or index at %d", tok.pos)
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+		default:
+			return &pathNode{keys}, nil
+		}
+	}
+}
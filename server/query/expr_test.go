@@ -0,0 +1,103 @@
+package query
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func mustNormalize(t *testing.T, s string) interface{} {
+	t.Helper()
+	v, err := Normalize(json.RawMessage(s))
+	if err != nil {
+		t.Fatalf("Normalize(%s): %s", s, err)
+	}
+	return v
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		ok   bool
+	}{
+		{`data.count > 100`, true},
+		{`data.chars.1.level == 80`, true},
+		{`value.skills.0.skillId == "skchr_amiya_1"`, true},
+		{`data.chars["1"].level`, true},
+		{`data.list[0]`, true},
+		{`exists(data.chars.1)`, true},
+		{`!(a || b) && c != null`, true},
+		{`a == 1.5e3`, true},
+		{``, false},
+		{`a ==`, false},
+		{`(a`, false},
+		{`a.`, false},
+		{`a[`, false},
+		{`a["b"`, false},
+		{`"unterminated`, false},
+		{`a # b`, false},
+		{`a b`, false},
+		{`exists(a, b)`, false},
+		{`unknown(a)`, false},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.expr)
+		if (err == nil) != test.ok {
+			t.Errorf("Parse(%q): got error %v, expected ok %t", test.expr, err, test.ok)
+		}
+	}
+}
+
+func TestEval(t *testing.T) {
+	root := mustNormalize(t, `{
+		"target": "S/gacha/refreshTags",
+		"data": {
+			"count": 120,
+			"name": "Amiya",
+			"flag": true,
+			"list": [1, 2, 3],
+			"chars": {"1": {"level": 80, "skills": [{"skillId": "skchr_amiya_1"}]}}
+		}
+	}`)
+	tests := []struct {
+		expr string
+		want interface{}
+	}{
+		{`data.count`, 120.0},
+		{`data.count > 100`, true},
+		{`data.count <= 100`, false},
+		{`data.name == "Amiya"`, true},
+		{`data.name != 'Amiya'`, false},
+		{`data.chars.1.level`, 80.0},
+		{`data.chars.1.level == 80`, true},
+		{`data.chars["1"].level`, 80.0},
+		{`data.chars.1.skills.0.skillId`, "skchr_amiya_1"},
+		{`data.chars.1.skills[0].skillId`, "skchr_amiya_1"},
+		{`data.list[1]`, 2.0},
+		{`data.list.2`, 3.0},
+		{`data.missing`, nil},
+		{`data.missing.deeper`, nil},
+		{`exists(data.chars.1)`, true},
+		{`exists(data.chars.2)`, false},
+		{`len(data.list)`, 3.0},
+		{`len(data.name)`, 5.0},
+		{`len(data.count)`, nil},
+		{`contains(data.list, 2)`, true},
+		{`contains(data.name, "mi")`, true},
+		{`data.flag && !(data.count < 0)`, true},
+		{`data.missing || data.flag`, true},
+		{`data.count == -120`, false},
+		{`data.missing == null`, true},
+		{`target == "S/gacha/refreshTags" && data.count > 1.2e2`, false},
+	}
+	for _, test := range tests {
+		expr, err := Parse(test.expr)
+		if err != nil {
+			t.Errorf("Parse(%q): %s", test.expr, err)
+			continue
+		}
+		if got := expr.Eval(root); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Eval(%q) = %#v, expected %#v", test.expr, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp // Operators and punctuation
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	num  float64
+	pos  int
+}
+
+// Operators sorted so that longer operators are matched first.
+var operators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", ".", "[", "]", "(", ")", ","}
+
+// lex splits an expression into tokens.
+func lex(s string) ([]token, error) {
+	var toks []token
+	i := 0
+	for i < len(s) {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '_' || unicode.IsLetter(c) || (unicode.IsDigit(c) && afterDot(toks)):
+			// Keys following a period may start with a digit, e.g., the
+			// numeric keys of 'chars.1.level', and are never numbers.
+			start := i
+			for i < len(s) && (s[i] == '_' || unicode.IsLetter(rune(s[i])) || unicode.IsDigit(rune(s[i]))) {
+				i++
+			}
+			toks = append(toks, token{kind: tokIdent, text: s[start:i], pos: start})
+		case unicode.IsDigit(c) || (c == '-' && i+1 < len(s) && unicode.IsDigit(rune(s[i+1]))):
+			start := i
+			i++
+			for i < len(s) && strings.ContainsRune("0123456789.eE+-", rune(s[i])) {
+				// Only allow signs directly after an exponent.
+				if (s[i] == '+' || s[i] == '-') && s[i-1] != 'e' && s[i-1] != 'E' {
+					break
+				}
+				i++
+			}
+			num, err := strconv.ParseFloat(s[start:i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid number '%s' at %d", s[start:i], start)
+			}
+			toks = append(toks, token{kind: tokNumber, text: s[start:i], num: num, pos: start})
+		case c == '"' || c == '\'':
+			start := i
+			i++
+			var sb strings.Builder
+			for ; i < len(s) && rune(s[i]) != c; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				sb.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, fmt.Errorf("Unterminated string at %d", start)
+			}
+			i++
+			toks = append(toks, token{kind: tokString, text: sb.String(), pos: start})
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(s[i:], op) {
+					toks = append(toks, token{kind: tokOp, text: op, pos: i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("Unexpected character '%c' at %d", c, i)
+			}
+		}
+	}
+	toks = append(toks, token{kind: tokEOF, pos: len(s)})
+	return toks, nil
+}
+
+// afterDot reports whether the last token is a period.
+func afterDot(toks []token) bool {
+	return len(toks) > 0 && toks[len(toks)-1].kind == tokOp && toks[len(toks)-1].text == "."
+}
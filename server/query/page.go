@@ -0,0 +1,101 @@
+package query
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+)
+
+// Cursors are opaque to clients. Object cursors hold the last key of the
+// previous page, so that pages stay consistent when keys are added or removed
+// between requests, while array cursors hold the index of the next element.
+const (
+	keyCursor   = 'k'
+	indexCursor = 'i'
+)
+
+// Page returns at most size elements of a normalized object or array, or of
+// the entries returned by a Query, starting where the page of the cursor ended.
+// The first page is returned if the cursor is empty. The cursor of the next
+// page is empty once there are no more elements.
+func Page(v interface{}, cursor string, size int) (page interface{}, next string, err error) {
+	if size <= 0 {
+		return nil, "", fmt.Errorf("Invalid page size %d", size)
+	}
+	kind, pos, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if kind == indexCursor {
+			return nil, "", fmt.Errorf("Invalid cursor '%s'", cursor)
+		}
+		keys := SortedKeys(t)
+		start := 0
+		if kind == keyCursor {
+			for start < len(keys) && !keyLess(pos, keys[start]) {
+				start++
+			}
+		}
+		end := min(start+size, len(keys))
+		ret := make(map[string]interface{}, end-start)
+		for _, k := range keys[start:end] {
+			ret[k] = t[k]
+		}
+		if end < len(keys) {
+			next = encodeCursor(keyCursor, keys[end-1])
+		}
+		return ret, next, nil
+	case []interface{}:
+		start, end, next, err := indexPage(kind, pos, cursor, size, len(t))
+		if err != nil {
+			return nil, "", err
+		}
+		return t[start:end], next, nil
+	case []Entry:
+		start, end, next, err := indexPage(kind, pos, cursor, size, len(t))
+		if err != nil {
+			return nil, "", err
+		}
+		return t[start:end], next, nil
+	}
+	return nil, "", fmt.Errorf("Pages require an object or array")
+}
+
+func indexPage(kind byte, pos, cursor string, size, n int) (start, end int, next string, err error) {
+	if kind != 0 {
+		start, err = strconv.Atoi(pos)
+		if kind == keyCursor || err != nil || start < 0 {
+			return 0, 0, "", fmt.Errorf("Invalid cursor '%s'", cursor)
+		}
+	}
+	start = min(start, n)
+	end = min(start+size, n)
+	if end < n {
+		next = encodeCursor(indexCursor, strconv.Itoa(end))
+	}
+	return start, end, next, nil
+}
+
+func encodeCursor(kind byte, pos string) string {
+	return base64.RawURLEncoding.EncodeToString(append([]byte{kind}, pos...))
+}
+
+func decodeCursor(cursor string) (kind byte, pos string, err error) {
+	if cursor == "" {
+		return 0, "", nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(b) == 0 || (b[0] != keyCursor && b[0] != indexCursor) {
+		return 0, "", fmt.Errorf("Invalid cursor '%s'", cursor)
+	}
+	return b[0], string(b[1:]), nil
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
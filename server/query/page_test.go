@@ -0,0 +1,107 @@
+package query
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// pages requests every page of a value and returns them encoded.
+func pages(t *testing.T, v interface{}, size int) []string {
+	t.Helper()
+	var ret []string
+	cursor := ""
+	for {
+		page, next, err := Page(v, cursor, size)
+		if err != nil {
+			t.Fatalf("Page(%q): %s", cursor, err)
+		}
+		b, _ := json.Marshal(page)
+		ret = append(ret, string(b))
+		if next == "" {
+			return ret
+		}
+		if len(ret) > 100 {
+			t.Fatal("Too many pages")
+		}
+		cursor = next
+	}
+}
+
+func TestPage(t *testing.T) {
+	tests := []struct {
+		value string
+		size  int
+		want  []string
+	}{
+		{`{"10":1,"2":2,"3":3,"a":4}`, 2, []string{`{"2":2,"3":3}`, `{"10":1,"a":4}`}},
+		{`{"10":1,"2":2,"3":3}`, 2, []string{`{"2":2,"3":3}`, `{"10":1}`}},
+		{`{"a":1}`, 5, []string{`{"a":1}`}},
+		{`{}`, 5, []string{`{}`}},
+		{`[1,2,3,4,5]`, 2, []string{`[1,2]`, `[3,4]`, `[5]`}},
+		{`[1,2]`, 2, []string{`[1,2]`}},
+		{`[]`, 2, []string{`[]`}},
+	}
+	for _, test := range tests {
+		got := pages(t, mustNormalize(t, test.value), test.size)
+		b, _ := json.Marshal(got)
+		want, _ := json.Marshal(test.want)
+		if string(b) != string(want) {
+			t.Errorf("Pages of %s = %s, expected %s", test.value, b, want)
+		}
+	}
+}
+
+func TestPageEntries(t *testing.T) {
+	entries := []Entry{{"a", 1.0}, {"b", 2.0}, {"c", 3.0}}
+	got := pages(t, entries, 2)
+	if len(got) != 2 || got[1] != `[{"key":"c","value":3}]` {
+		t.Errorf("Pages of entries = %v", got)
+	}
+}
+
+func TestPageCursorKeys(t *testing.T) {
+	// Object cursors hold the last key of the page, so removing keys of a page
+	// that was already sent doesn't skip elements.
+	m := mustNormalize(t, `{"1":1,"2":2,"3":3,"4":4}`).(map[string]interface{})
+	_, next, err := Page(m, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(m, "1")
+	delete(m, "2")
+	m["0"] = 0.0
+	page, next, err := Page(m, next, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := json.Marshal(page); string(b) != `{"3":3,"4":4}` || next != "" {
+		t.Errorf("Page after removal = %s, next %q", b, next)
+	}
+}
+
+func TestPageErrors(t *testing.T) {
+	obj := mustNormalize(t, `{"a":1,"b":2}`)
+	arr := mustNormalize(t, `[1,2,3]`)
+	_, objCursor, _ := Page(obj, "", 1)
+	_, arrCursor, _ := Page(arr, "", 1)
+	tests := []struct {
+		value  interface{}
+		cursor string
+		size   int
+	}{
+		{obj, "", 0},
+		{obj, "", -1},
+		{obj, "not base64!", 1},
+		{obj, "eA", 1}, // Unknown cursor kind 'x'
+		{obj, arrCursor, 1},
+		{arr, objCursor, 1},
+		{arr, "aS0x", 1}, // Negative index
+		{1.0, "", 1},
+		{"string", "", 1},
+	}
+	for _, test := range tests {
+		if _, _, err := Page(test.value, test.cursor, test.size); err == nil {
+			t.Errorf("Page(%v, %q, %d) didn't fail", test.value, test.cursor, test.size)
+		}
+	}
+}
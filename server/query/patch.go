@@ -0,0 +1,98 @@
+package query
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PatchOp is a JSON Patch operation as defined in RFC 6902.
+type PatchOp struct {
+	Op    string // 'add', 'remove' or 'replace'
+	Path  string // JSON Pointer as defined in RFC 6901
+	Value interface{}
+}
+
+// MarshalJSON omits the value of remove operations.
+func (op PatchOp) MarshalJSON() ([]byte, error) {
+	if op.Op == "remove" {
+		return json.Marshal(struct {
+			Op   string `json:"op"`
+			Path string `json:"path"`
+		}{op.Op, op.Path})
+	}
+	return json.Marshal(struct {
+		Op    string      `json:"op"`
+		Path  string      `json:"path"`
+		Value interface{} `json:"value"`
+	}{op.Op, op.Path, op.Value})
+}
+
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// Diff returns the JSON Patch that transforms the normalized JSON value a into
+// b. An empty patch is returned if the values are equal.
+func Diff(a, b interface{}) []PatchOp {
+	return diff(nil, "", a, b)
+}
+
+func diff(ops []PatchOp, path string, a, b interface{}) []PatchOp {
+	switch x := a.(type) {
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		// Sort the keys so that patches are deterministic.
+		keys := make([]string, 0, len(x)+len(y))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		for k := range y {
+			if _, exists := x[k]; !exists {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			childPath := path + "/" + pointerEscaper.Replace(k)
+			xv, inX := x[k]
+			yv, inY := y[k]
+			switch {
+			case !inY:
+				ops = append(ops, PatchOp{Op: "remove", Path: childPath})
+			case !inX:
+				ops = append(ops, PatchOp{Op: "add", Path: childPath, Value: yv})
+			default:
+				ops = diff(ops, childPath, xv, yv)
+			}
+		}
+		return ops
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		n := len(x)
+		if len(y) < n {
+			n = len(y)
+		}
+		for i := 0; i < n; i++ {
+			ops = diff(ops, path+"/"+strconv.Itoa(i), x[i], y[i])
+		}
+		// Remove trailing elements from the back so indices stay valid.
+		for i := len(x) - 1; i >= len(y); i-- {
+			ops = append(ops, PatchOp{Op: "remove", Path: path + "/" + strconv.Itoa(i)})
+		}
+		for i := len(x); i < len(y); i++ {
+			ops = append(ops, PatchOp{Op: "add", Path: path + "/-", Value: y[i]})
+		}
+		return ops
+	default:
+		if equal(a, b) {
+			return ops
+		}
+	}
+	return append(ops, PatchOp{Op: "replace", Path: path, Value: b})
+}
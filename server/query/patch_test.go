@@ -0,0 +1,33 @@
+package query
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want string
+	}{
+		{`1`, `1`, `null`},
+		{`1`, `2`, `[{"op":"replace","path":"","value":2}]`},
+		{`{"a":1,"b":2}`, `{"a":1,"b":3}`, `[{"op":"replace","path":"/b","value":3}]`},
+		{`{"a":1}`, `{"b":1}`, `[{"op":"remove","path":"/a"},{"op":"add","path":"/b","value":1}]`},
+		{`{"a/b":1,"c~d":1}`, `{"a/b":2,"c~d":2}`,
+			`[{"op":"replace","path":"/a~1b","value":2},{"op":"replace","path":"/c~0d","value":2}]`},
+		{`[1,2,3]`, `[1,4]`, `[{"op":"replace","path":"/1","value":4},{"op":"remove","path":"/2"}]`},
+		{`[1]`, `[1,2,3]`, `[{"op":"add","path":"/-","value":2},{"op":"add","path":"/-","value":3}]`},
+		{`{"a":[1]}`, `{"a":{"0":1}}`, `[{"op":"replace","path":"/a","value":{"0":1}}]`},
+	}
+	for _, test := range tests {
+		patch := Diff(mustNormalize(t, test.a), mustNormalize(t, test.b))
+		b, err := json.Marshal(patch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != test.want {
+			t.Errorf("Diff(%s, %s) = %s, expected %s", test.a, test.b, b, test.want)
+		}
+	}
+}
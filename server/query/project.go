@@ -0,0 +1,77 @@
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Projection selects a subset of fields from a JSON value. Fields are period
+// separated paths where '*' matches every key of an object or element of an
+// array, e.g., '*.level' selects the level of every operator in 'troop.chars'.
+type Projection [][]string
+
+// NewProjection parses a list of fields into a Projection.
+func NewProjection(fields []string) (Projection, error) {
+	p := make(Projection, 0, len(fields))
+	for _, field := range fields {
+		keys := strings.Split(field, ".")
+		for _, key := range keys {
+			if key == "" {
+				return nil, fmt.Errorf("Invalid field '%s'", field)
+			}
+		}
+		p = append(p, keys)
+	}
+	return p, nil
+}
+
+// Apply returns a copy of a normalized JSON value containing only the fields
+// selected by the projection. Fields that do not exist are omitted.
+func (p Projection) Apply(v interface{}) interface{} {
+	ret, _ := project(v, p)
+	return ret
+}
+
+func project(v interface{}, paths [][]string) (interface{}, bool) {
+	for _, path := range paths {
+		if len(path) == 0 {
+			// The whole value is selected.
+			return v, true
+		}
+	}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		ret := make(map[string]interface{})
+		for key, val := range t {
+			if sub := descend(paths, key); len(sub) > 0 {
+				if projected, ok := project(val, sub); ok {
+					ret[key] = projected
+				}
+			}
+		}
+		return ret, true
+	case []interface{}:
+		ret := make([]interface{}, 0, len(t))
+		for i, val := range t {
+			if sub := descend(paths, strconv.Itoa(i)); len(sub) > 0 {
+				if projected, ok := project(val, sub); ok {
+					ret = append(ret, projected)
+				}
+			}
+		}
+		return ret, true
+	}
+	return nil, false
+}
+
+// descend returns the remainder of the paths whose first key matches key.
+func descend(paths [][]string, key string) [][]string {
+	var ret [][]string
+	for _, path := range paths {
+		if path[0] == "*" || path[0] == key {
+			ret = append(ret, path[1:])
+		}
+	}
+	return ret
+}
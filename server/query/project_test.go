@@ -0,0 +1,31 @@
+package query
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProjection(t *testing.T) {
+	v := mustNormalize(t, `{"1": {"charId": "a", "level": 80}, "2": {"charId": "b", "level": 1}}`)
+	tests := []struct {
+		fields []string
+		want   string
+	}{
+		{[]string{"*.level"}, `{"1": {"level": 80}, "2": {"level": 1}}`},
+		{[]string{"1"}, `{"1": {"charId": "a", "level": 80}}`},
+		{[]string{"1.charId", "2.level"}, `{"1": {"charId": "a"}, "2": {"level": 1}}`},
+		{[]string{"3.level"}, `{}`},
+	}
+	for _, test := range tests {
+		p, err := NewProjection(test.fields)
+		if err != nil {
+			t.Fatalf("NewProjection(%v): %s", test.fields, err)
+		}
+		if got, want := p.Apply(v), mustNormalize(t, test.want); !reflect.DeepEqual(got, want) {
+			t.Errorf("Apply(%v) = %v, expected %v", test.fields, got, want)
+		}
+	}
+	if _, err := NewProjection([]string{"a..b"}); err == nil {
+		t.Error("NewProjection accepted an empty key")
+	}
+}
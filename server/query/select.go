@@ -0,0 +1,179 @@
+package query
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Entry is an element of an object or array selected by a Query, along with
+// its key, a string for objects or a number for arrays.
+type Entry struct {
+	Key   interface{} `json:"key"`
+	Value interface{} `json:"value"`
+}
+
+// SortKey is an expression that elements are sorted by.
+type SortKey struct {
+	Expr *Expr
+	Desc bool
+}
+
+// ParseSort parses a list of sort expressions, expressions prefixed with '-'
+// sort in descending order.
+func ParseSort(keys []string) ([]SortKey, error) {
+	ret := make([]SortKey, 0, len(keys))
+	for _, key := range keys {
+		desc := strings.HasPrefix(key, "-")
+		expr, err := Parse(strings.TrimPrefix(key, "-"))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid sort '%s': %s", key, err)
+		}
+		ret = append(ret, SortKey{expr, desc})
+	}
+	return ret, nil
+}
+
+// Query selects, sorts and limits the elements of an object or array. The
+// where and sort expressions are evaluated against an object with the key and
+// value of each element, e.g., 'value.evolvePhase == 2' or '-value.level'.
+type Query struct {
+	Where  *Expr
+	Sort   []SortKey
+	Limit  int // No limit if 0
+	Fields Projection
+}
+
+// Run returns the entries of a normalized object or array that match the
+// query. Elements are in the order of the array, or of the object's keys, until
+// they are sorted. The query's projection is applied to the value of every
+// entry.
+func (q *Query) Run(v interface{}) ([]Entry, error) {
+	var entries []Entry
+	switch t := v.(type) {
+	case map[string]interface{}:
+		keys := SortedKeys(t)
+		entries = make([]Entry, 0, len(keys))
+		for _, k := range keys {
+			entries = append(entries, Entry{k, t[k]})
+		}
+	case []interface{}:
+		entries = make([]Entry, 0, len(t))
+		for i, val := range t {
+			entries = append(entries, Entry{float64(i), val})
+		}
+	default:
+		return nil, fmt.Errorf("Queries require an object or array")
+	}
+	if q.Where != nil {
+		matched := entries[:0]
+		for _, e := range entries {
+			if q.Where.Match(e.root()) {
+				matched = append(matched, e)
+			}
+		}
+		entries = matched
+	}
+	if len(q.Sort) > 0 {
+		sortEntries(entries, q.Sort)
+	}
+	if q.Limit > 0 && len(entries) > q.Limit {
+		entries = entries[:q.Limit]
+	}
+	if len(q.Fields) > 0 {
+		for i := range entries {
+			if entries[i].Value != nil {
+				entries[i].Value = q.Fields.Apply(entries[i].Value)
+			}
+		}
+	}
+	return entries, nil
+}
+
+// root returns the value expressions are evaluated against.
+func (e Entry) root() map[string]interface{} {
+	return map[string]interface{}{"key": e.Key, "value": e.Value}
+}
+
+func sortEntries(entries []Entry, keys []SortKey) {
+	// Evaluate the sort keys once per entry.
+	vals := make(map[int][]interface{}, len(entries))
+	idx := make([]int, len(entries))
+	for i, e := range entries {
+		idx[i] = i
+		root := e.root()
+		for _, key := range keys {
+			vals[i] = append(vals[i], key.Expr.Eval(root))
+		}
+	}
+	sort.SliceStable(idx, func(a, b int) bool {
+		for k, key := range keys {
+			x, y := vals[idx[a]][k], vals[idx[b]][k]
+			if (x == nil) != (y == nil) {
+				// Elements without a value sort last in either direction.
+				return y == nil
+			}
+			c := order(x, y)
+			if c == 0 {
+				continue
+			}
+			if key.Desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+	sorted := make([]Entry, len(entries))
+	for i, j := range idx {
+		sorted[i] = entries[j]
+	}
+	copy(entries, sorted)
+}
+
+// order compares values for sorting, values that are not ordered with each
+// other are ordered by type.
+func order(a, b interface{}) int {
+	if c, ok := compare(a, b); ok {
+		return c
+	}
+	return typeRank(a) - typeRank(b)
+}
+
+func typeRank(v interface{}) int {
+	switch v.(type) {
+	case float64:
+		return 0
+	case string:
+		return 1
+	case bool:
+		return 2
+	}
+	return 3
+}
+
+// SortedKeys returns the keys of an object in the order used by queries and
+// pages.
+func SortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keyLess(keys[i], keys[j]) })
+	return keys
+}
+
+// keyLess orders object keys numerically if they are numbers, as is the case
+// for most keys of the game state, followed by the other keys in lexical order.
+func keyLess(a, b string) bool {
+	x, errA := strconv.ParseFloat(a, 64)
+	y, errB := strconv.ParseFloat(b, 64)
+	if (errA == nil) != (errB == nil) {
+		return errA == nil
+	}
+	if errA == nil && x != y {
+		return x < y
+	}
+	return a < b
+}
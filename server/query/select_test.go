@@ -0,0 +1,70 @@
+package query
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestQueryRun(t *testing.T) {
+	chars := `{
+		"10": {"level": 5, "evolvePhase": 2},
+		"2": {"level": 9, "evolvePhase": 2},
+		"3": {"level": 1, "evolvePhase": 1},
+		"4": {"evolvePhase": 2}
+	}`
+	tests := []struct {
+		value  string
+		where  string
+		sort   []string
+		limit  int
+		fields []string
+		want   string
+	}{
+		{chars, "", nil, 0, []string{"level"},
+			`[{"key":"2","value":{"level":9}},{"key":"3","value":{"level":1}},{"key":"4","value":{}},{"key":"10","value":{"level":5}}]`},
+		{chars, "value.evolvePhase == 2", []string{"-value.level"}, 0, []string{"level"},
+			`[{"key":"2","value":{"level":9}},{"key":"10","value":{"level":5}},{"key":"4","value":{}}]`},
+		{chars, "value.evolvePhase == 2", []string{"value.level"}, 2, []string{"level"},
+			`[{"key":"10","value":{"level":5}},{"key":"2","value":{"level":9}}]`},
+		{chars, "key == \"3\"", nil, 0, nil,
+			`[{"key":"3","value":{"evolvePhase":1,"level":1}}]`},
+		{`[3, 1, 2]`, "value > 1", []string{"value"}, 0, nil,
+			`[{"key":2,"value":2},{"key":0,"value":3}]`},
+		{`{"b": 1, "a": 1, "1": 2}`, "", []string{"value", "-key"}, 0, nil,
+			`[{"key":"b","value":1},{"key":"a","value":1},{"key":"1","value":2}]`},
+	}
+	for _, test := range tests {
+		q := &Query{Limit: test.limit}
+		var err error
+		if test.where != "" {
+			if q.Where, err = Parse(test.where); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if q.Sort, err = ParseSort(test.sort); err != nil {
+			t.Fatal(err)
+		}
+		if q.Fields, err = NewProjection(test.fields); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := q.Run(mustNormalize(t, test.value))
+		if err != nil {
+			t.Fatalf("Run(%s): %s", test.value, err)
+		}
+		b, _ := json.Marshal(entries)
+		if string(b) != test.want {
+			t.Errorf("Run(%s, %q, %v) = %s, expected %s", test.value, test.where, test.sort, b, test.want)
+		}
+	}
+	if _, err := (&Query{}).Run(1.0); err == nil {
+		t.Error("Run accepted a number")
+	}
+}
+
+func TestSortedKeys(t *testing.T) {
+	m := map[string]interface{}{"b": 0, "10": 0, "9": 0, "a": 0, "1a": 0, "2": 0}
+	b, _ := json.Marshal(SortedKeys(m))
+	if want := `["2","9","10","1a","a","b"]`; string(b) != want {
+		t.Errorf("SortedKeys = %s, expected %s", b, want)
+	}
+}
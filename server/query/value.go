@@ -0,0 +1,128 @@
+package query
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+)
+
+// Normalize converts a value into its generic JSON representation, i.e.,
+// map[string]interface{}, []interface{}, float64, string, bool or nil, by
+// marshalling and unmarshalling it. json.RawMessage values are unmarshalled
+// directly.
+func Normalize(v interface{}) (interface{}, error) {
+	var b []byte
+	switch t := v.(type) {
+	case nil:
+		return nil, nil
+	case json.RawMessage:
+		b = t
+	default:
+		var err error
+		b, err = json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var ret interface{}
+	err := json.Unmarshal(b, &ret)
+	return ret, err
+}
+
+// child returns the value of a key in an object, or an index in an array.
+func child(v interface{}, key string) (interface{}, bool) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		val, ok := t[key]
+		return val, ok
+	case []interface{}:
+		i, err := strconv.Atoi(key)
+		if err != nil || i < 0 || i >= len(t) {
+			return nil, false
+		}
+		return t[i], true
+	}
+	return nil, false
+}
+
+// truthy reports whether a value is considered true in a boolean context.
+func truthy(v interface{}) bool {
+	switch t := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return t
+	case float64:
+		return t != 0
+	case string:
+		return t != ""
+	}
+	return true
+}
+
+// compare returns -1, 0 or 1 if a is less than, equal to, or greater than b.
+// ok is false if the values are of different types or are not ordered.
+func compare(a, b interface{}) (ret int, ok bool) {
+	switch x := a.(type) {
+	case float64:
+		y, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func equal(a, b interface{}) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+// TypeOf returns the JSON type of a normalized value, one of 'object',
+// 'array', 'string', 'number', 'boolean' or 'null'.
+func TypeOf(v interface{}) string {
+	switch v.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	}
+	return "null"
+}
+
+// Length returns the length of a string, object or array and -1 otherwise.
+func Length(v interface{}) int {
+	switch t := v.(type) {
+	case string:
+		return len(t)
+	case map[string]interface{}:
+		return len(t)
+	case []interface{}:
+		return len(t)
+	}
+	return -1
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/kyoukaya/angelina/server/msg"
+)
+
+const (
+	// Time a disconnected client's session is kept for it to be resumed.
+	sessionGrace = 60 * time.Second
+
+	// Number of hook events kept by a session to be replayed on resume, and of
+	// other messages held while it is suspended. Their sum must be less than
+	// the size of the Client's send chan.
+	sessionBufSiz  = 100
+	sessionHeldSiz = 20
+)
+
+// session holds the hook event stream of a client, which outlives the
+// websocket connection for sessionGrace to allow the client to reconnect with
+// C_Resume and receive the events it missed.
+type session struct {
+	token string
+	ange  *Ange
+	// Incremented every time the session is suspended, used to ignore expiry
+	// timers of previous suspensions. Only accessed from the hub.
+	epoch uint64
+
+	// Guards the fields below as hook events are sent from the hooks' goroutines.
+	mutex  sync.Mutex
+	client *Client  // Current connection, nil while suspended
+	seq    uint64   // Sequence number of the last hook event sent
+	buffer [][]byte // Last hook events sent, buffer[len(buffer)-1] has seq
+	// Messages other than hook events sent while suspended, e.g., S_HookExpired
+	// or S_WaitResult, sent after the events on resume.
+	held [][]byte
+}
+
+// sessionExpiry is sent to the hub when a suspended session's grace period
+// runs out.
+type sessionExpiry struct {
+	token string
+	epoch uint64
+}
+
+func newSession(ange *Ange, client *Client) *session {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return &session{
+		token:  hex.EncodeToString(b),
+		ange:   ange,
+		client: client,
+	}
+}
+
+// sendHookEvt assigns the next sequence number to a hook event, buffers it and
+// sends it to the current connection if any.
+func (s *session) sendHookEvt(evt *msg.HookEvt) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.seq++
+	evt.Seq = s.seq
+	b, err := msg.ServerHookEvt(evt)
+	if err != nil {
+		s.ange.Warnln("[Ange] ", err)
+		return
+	}
+	if len(s.buffer) == sessionBufSiz {
+		s.buffer = append(s.buffer[:0], s.buffer[1:]...)
+	}
+	s.buffer = append(s.buffer, b)
+	if s.client != nil {
+		s.client.push(b)
+	}
+}
+
+// hold keeps a message sent to the session's client while the session is
+// suspended, and reports whether it did. The oldest messages are discarded
+// once sessionHeldSiz messages are held.
+func (s *session) hold(b []byte) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.client != nil {
+		return false
+	}
+	if len(s.held) == sessionHeldSiz {
+		s.held = append(s.held[:0], s.held[1:]...)
+	}
+	s.held = append(s.held, b)
+	return true
+}
+
+// suspend detaches the session from its connection and starts the grace
+// period after which the session expires.
+func (s *session) suspend() {
+	s.mutex.Lock()
+	s.client = nil
+	s.mutex.Unlock()
+	s.epoch++
+	expiry := sessionExpiry{s.token, s.epoch}
+	time.AfterFunc(sessionGrace, func() {
+		s.ange.sessionExpired <- expiry
+	})
+}
+
+// resume attaches the session to a new connection and replays the events sent
+// after lastSeq, followed by the messages held while it was suspended. notify
+// is called before the events are replayed with the sequence number of the last
+// event sent, and whether all the events after lastSeq are still buffered.
+func (s *session) resume(client *Client, lastSeq uint64, notify func(seq uint64, complete bool)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.client = client
+	defer func() {
+		for _, b := range s.held {
+			client.push(b)
+		}
+		s.held = nil
+	}()
+	if lastSeq >= s.seq {
+		notify(s.seq, true)
+		return
+	}
+	missed := s.seq - lastSeq
+	complete := missed <= uint64(len(s.buffer))
+	if !complete {
+		missed = uint64(len(s.buffer))
+	}
+	notify(s.seq, complete)
+	for _, b := range s.buffer[uint64(len(s.buffer))-missed:] {
+		client.push(b)
+	}
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+
+	"github.com/kyoukaya/angelina/server/msg"
+	"github.com/kyoukaya/angelina/server/query"
+)
+
+// Size of the data of S_GetChunk messages of C_Get requests that don't specify
+// one.
+const defaultChunkBytes = 16 << 10
+
+// stream sends a C_Get reply as S_GetChunk messages followed by S_GetEnd, all
+// tagged with the ID of the request. Chunks are encoded and sent from another
+// goroutine so that large values neither block the hub nor the client's other
+// messages. val must not share memory with the game state. A S_Error is sent
+// instead of the remaining messages if the value fails to be encoded.
+func (c *Client) stream(get *msg.Get, val interface{}, next string, payload []byte) {
+	size := defaultChunkBytes
+	if get.ChunkBytes > 0 {
+		size = get.ChunkBytes
+	}
+	reqID := c.reqID
+	go func() {
+		err := c.sendChunks(get, val, next, size, reqID)
+		if err == nil {
+			return
+		}
+		c.ange.Warnln("[Ange] ", err)
+		b, err := msg.ServerError(payload, msg.CodeInternal, err.Error())
+		if err != nil {
+			c.ange.Warnln("[Ange] ", err)
+			return
+		}
+		select {
+		case c.chunks <- msg.TagRequest(b, reqID):
+		case <-c.quit:
+		}
+	}()
+}
+
+// sendChunks encodes and sends the messages of a stream, it returns early
+// without an error if the client quits.
+func (c *Client) sendChunks(get *msg.Get, val interface{}, next string, size int, reqID string) error {
+	chunks, err := splitChunks(val, size)
+	if err != nil {
+		return err
+	}
+	for i, chunk := range chunks {
+		b, err := msg.ServerGetChunk(get.Path, i+1, chunk)
+		if err != nil {
+			return err
+		}
+		select {
+		case c.chunks <- msg.TagRequest(b, reqID):
+		case <-c.quit:
+			return nil
+		}
+	}
+	b, err := msg.ServerGetEnd(get.Path, len(chunks), next)
+	if err != nil {
+		return err
+	}
+	select {
+	case c.chunks <- msg.TagRequest(b, reqID):
+	case <-c.quit:
+	}
+	return nil
+}
+
+// splitChunks encodes a value into chunks of about size bytes. Objects and
+// arrays are split between their elements, and clients rebuild them by merging
+// or concatenating the chunks in order. Elements larger than size are sent in a
+// chunk of their own, and other values are sent in a single chunk.
+func splitChunks(val interface{}, size int) ([][]byte, error) {
+	var elems [][]byte
+	start, end := byte('['), byte(']')
+	switch t := val.(type) {
+	case map[string]interface{}:
+		start, end = '{', '}'
+		for _, k := range query.SortedKeys(t) {
+			key, err := json.Marshal(k)
+			if err != nil {
+				return nil, err
+			}
+			v, err := json.Marshal(t[k])
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, append(append(key, ':'), v...))
+		}
+	case []interface{}:
+		for _, v := range t {
+			b, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, b)
+		}
+	case []query.Entry:
+		for _, v := range t {
+			b, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, b)
+		}
+	default:
+		b, err := json.Marshal(val)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{b}, nil
+	}
+	chunks := [][]byte{}
+	chunk := []byte{start}
+	for _, elem := range elems {
+		if len(chunk) > 1 && len(chunk)+len(elem)+2 > size {
+			chunks = append(chunks, append(chunk, end))
+			chunk = []byte{start}
+		}
+		if len(chunk) > 1 {
+			chunk = append(chunk, ',')
+		}
+		chunk = append(chunk, elem...)
+	}
+	return append(chunks, append(chunk, end)), nil
+}
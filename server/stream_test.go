@@ -0,0 +1,60 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/kyoukaya/angelina/server/query"
+)
+
+func TestSplitChunks(t *testing.T) {
+	tests := []struct {
+		value string
+		size  int
+		want  []string
+	}{
+		{`5`, 1, []string{`5`}},
+		{`"str"`, 1, []string{`"str"`}},
+		{`{}`, 10, []string{`{}`}},
+		{`[]`, 10, []string{`[]`}},
+		{`{"10":{"a":1},"2":{"a":2},"3":3,"x":[1,2,3]}`, 20,
+			[]string{`{"2":{"a":2},"3":3}`, `{"10":{"a":1}}`, `{"x":[1,2,3]}`}},
+		{`[1,2,3,4]`, 5, []string{`[1,2]`, `[3,4]`}},
+		// Elements larger than the chunk size are sent on their own.
+		{`["aaaaaaaa","b"]`, 4, []string{`["aaaaaaaa"]`, `["b"]`}},
+		{`{"a":1}`, 1 << 10, []string{`{"a":1}`}},
+	}
+	for _, test := range tests {
+		v, err := query.Normalize(json.RawMessage(test.value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks, err := splitChunks(v, test.size)
+		if err != nil {
+			t.Fatalf("splitChunks(%s): %s", test.value, err)
+		}
+		got := make([]string, len(chunks))
+		for i, chunk := range chunks {
+			got[i] = string(chunk)
+			if !json.Valid(chunk) {
+				t.Errorf("splitChunks(%s): invalid chunk %s", test.value, chunk)
+			}
+		}
+		b, _ := json.Marshal(got)
+		want, _ := json.Marshal(test.want)
+		if string(b) != string(want) {
+			t.Errorf("splitChunks(%s, %d) = %s, expected %s", test.value, test.size, b, want)
+		}
+	}
+}
+
+func TestSplitChunksEntries(t *testing.T) {
+	entries := []query.Entry{{Key: "a", Value: 1.0}, {Key: "b", Value: 2.0}}
+	chunks, err := splitChunks(entries, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 2 || string(chunks[1]) != `[{"key":"b","value":2}]` {
+		t.Errorf("splitChunks(entries) = %q", chunks)
+	}
+}
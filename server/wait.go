@@ -0,0 +1,148 @@
+package server
+
+import (
+	"time"
+
+	"github.com/kyoukaya/rhine/proxy/gamestate"
+
+	"github.com/kyoukaya/angelina/server/msg"
+)
+
+// Timeout of C_WaitFor requests that don't specify one.
+const defaultWaitTimeout = 30 * time.Second
+
+// waiter is a pending C_WaitFor request. It's implemented as a hook that isn't
+// exposed to the client and is removed by the hub after its first matching
+// event or timeout.
+type waiter struct {
+	hook    *clientHook
+	reqID   string // ID of the request, the result is tagged with it
+	timeout time.Duration
+}
+
+// waitResult is sent to the hub when a waiter matches an event or times out.
+type waitResult struct {
+	token  string // Token of the session the waiter belongs to
+	waiter *waiter
+	status string
+	data   hookData
+}
+
+// waitFor starts waiting for an event on the user of an attachment. The result
+// is sent immediately if the condition is met by the current value of a
+// gamestate target.
+func (c *Client) waitFor(a *attachment, data *msg.WaitFor) error {
+	if data.TimeoutMS < 0 {
+		return newError(msg.CodeBadPayload, "Invalid timeout_ms %d", data.TimeoutMS)
+	}
+	ch, err := newClientHook(c, 0, a.user, &msg.Hook{
+		Kind:   data.Kind,
+		Target: data.Target,
+		Filter: data.Condition,
+		Fields: data.Fields,
+	})
+	if err != nil {
+		return err
+	}
+	w := &waiter{hook: ch, reqID: c.reqID, timeout: defaultWaitTimeout}
+	if data.TimeoutMS > 0 {
+		w.timeout = time.Duration(data.TimeoutMS) * time.Millisecond
+	}
+	if data.Kind == gameStateHook && ch.filter != nil {
+		if err := c.stateReady(a); err != nil {
+			return err
+		}
+	}
+	if err := ch.register(a.mod); err != nil {
+		ch.Unhook()
+		return err
+	}
+	if data.Kind == gameStateHook && ch.filter != nil {
+		val, err := a.mod.StateGet(data.Target)
+		if err != nil {
+			ch.Unhook()
+			return wrapError(msg.CodeStatePathNotFound, err)
+		}
+		if d, ok := ch.accept(gamestate.StateEvent{Path: data.Target, Payload: val}); ok {
+			ch.Unhook()
+			c.sendWaitResult(w, msg.WaitMatched, d)
+			return nil
+		}
+	}
+	c.waits[w] = true
+	go w.run()
+	return nil
+}
+
+// run waits for the first event that passes the hook's filter and notifies the
+// hub, events are discarded afterwards until the hub unhooks it.
+func (w *waiter) run() {
+	ch := w.hook
+	timer := time.NewTimer(w.timeout)
+	defer timer.Stop()
+	res := waitResult{token: ch.sess.token, waiter: w, status: msg.WaitTimeout}
+wait:
+	for {
+		select {
+		case evt := <-ch.listener:
+			if d, ok := ch.accept(evt); ok {
+				res.status, res.data = msg.WaitMatched, d
+				break wait
+			}
+		case <-timer.C:
+			break wait
+		case <-ch.done:
+			return
+		}
+	}
+	for {
+		select {
+		case ch.sess.ange.waitDone <- res:
+		case <-ch.listener:
+			continue
+		case <-ch.done:
+		}
+		return
+	}
+}
+
+// sendWaitResult sends the result of a C_WaitFor request, tagged with the ID of
+// the request.
+func (c *Client) sendWaitResult(w *waiter, status string, d hookData) {
+	ch := w.hook
+	result := &msg.WaitResult{
+		Status: status,
+		User:   ch.user,
+		Kind:   ch.kind,
+		Target: ch.target,
+	}
+	if status == msg.WaitMatched {
+		result.Target = d.target
+		result.Data = d.data
+		if ch.fields != nil && d.data != nil {
+			result.Data = ch.fields.Apply(d.data)
+		}
+	}
+	ret, err := msg.ServerWaitResult(result)
+	if err != nil {
+		c.ange.Warnln("[Ange] ", err)
+		return
+	}
+	c.sendWrapper(msg.TagRequest(ret, w.reqID))
+}
+
+// finishWait removes a waiter from the client and sends its result.
+func (c *Client) finishWait(w *waiter, status string, d hookData) {
+	delete(c.waits, w)
+	w.hook.Unhook()
+	c.sendWaitResult(w, status, d)
+}
+
+// cancelWaits ends the client's pending C_WaitFor requests on a user.
+func (c *Client) cancelWaits(user string) {
+	for w := range c.waits {
+		if w.hook.user == user {
+			c.finishWait(w, msg.WaitDetached, hookData{})
+		}
+	}
+}